@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/upgrader"
+)
+
+const commandUsage = `Commands:
+  status                 show services and packages of the running daemon
+  check <package>        look for a newer version without installing it
+  upgrade <package>      check, download and install now
+  rollback <package>     reinstall the previous cached version
+  pause                  pause scheduled upgrades
+  resume                 resume scheduled upgrades
+  history [name]         show the upgrade history, optionally of one package
+                         or service; --since 24h|<RFC 3339>, --type upgrade.*,
+                         --limit N (default 200)
+  validate-config        check the configuration file
+Add --json to print JSON instead of tables.
+`
+
+type controlClient struct {
+	client *http.Client
+}
+
+func newControlClient(socket string) *controlClient {
+	return &controlClient{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, `unix`, socket)
+		},
+	}}}
+}
+
+func (c *controlClient) call(method, path string, reply interface{}) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(method, `http://daemonupgrader`+path, nil); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
+		return fmt.Errorf(`daemon is not reachable: %s`, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e errorReply
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != `` {
+			return fmt.Errorf(`%s`, e.Error)
+		}
+		return fmt.Errorf(`unexpected status %s`, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return `-`
+	}
+	return t.Local().Format(`2006-01-02 15:04:05`)
+}
+
+func orDash(s string) string {
+	if s == `` {
+		return `-`
+	}
+	return s
+}
+
+func printJson(out io.Writer, v interface{}) {
+	var encoder = json.NewEncoder(out)
+	encoder.SetIndent(``, `  `)
+	_ = encoder.Encode(v)
+}
+
+func printStatus(out io.Writer, report statusReport) {
+	fmt.Fprintf(out, "version: %s  started: %s  paused: %t\n\n", orDash(report.Version), formatTime(report.Started), report.Paused)
+	var w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if len(report.Services) > 0 {
+		fmt.Fprintln(w, "SERVICE\tSTATUS\tINTERVAL\tTASK")
+		for _, item := range report.Services {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Name, item.Status, item.Interval, orDash(item.Task))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "PACKAGE\tVERSION\tREMOTE\tSTAGED\tLAST CHECK\tTASK\tERROR")
+	for _, item := range report.Packages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.Name, orDash(item.LocalVersion), orDash(item.RemoteVersion),
+			orDash(item.Staged), formatTime(item.LastCheck), orDash(item.Task), orDash(item.LastError))
+	}
+	_ = w.Flush()
+}
+
+func printPackage(out io.Writer, report checkReport) {
+	var w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "package:\t%s\n", report.Name)
+	fmt.Fprintf(w, "version:\t%s\n", orDash(report.LocalVersion))
+	fmt.Fprintf(w, "remote:\t%s\n", orDash(report.RemoteVersion))
+	fmt.Fprintf(w, "available:\t%t\n", report.Available)
+	fmt.Fprintf(w, "staged:\t%s\n", orDash(report.Staged))
+	fmt.Fprintf(w, "last check:\t%s\n", formatTime(report.LastCheck))
+	fmt.Fprintf(w, "last upgrade:\t%s\n", formatTime(report.LastUpgrade))
+	fmt.Fprintf(w, "error:\t%s\n", orDash(report.Error))
+	_ = w.Flush()
+}
+
+func printEvents(out io.Writer, events []upgrader.Event) {
+	var w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tNAME\tVERSION\tDURATION\tERROR")
+	for _, event := range events {
+		var name = event.Package
+		if name == `` {
+			name = event.Service
+		}
+		var duration = `-`
+		if event.Duration > 0 {
+			duration = event.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", formatTime(event.Time), event.Type, orDash(name), orDash(event.Version), duration, orDash(event.Error))
+	}
+	_ = w.Flush()
+}
+
+type configProblem struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// validateConfig prepares every package the way the daemon does on start,
+// without running anything.
+func validateConfig(conf *ServiceConfig) (problems []configProblem) {
+	problems = make([]configProblem, 0)
+	var u = upgrader.New(upgrader.Options{Http: conf.Http})
+	var names = make(map[string]bool)
+	for i := range conf.Packages {
+		var packageInfo = &conf.Packages[i]
+		if names[packageInfo.Name] {
+			problems = append(problems, configProblem{Name: packageInfo.Name, Error: `duplicate package name`})
+		}
+		names[packageInfo.Name] = true
+		if err := u.Prepare(packageInfo); err != nil {
+			problems = append(problems, configProblem{Name: packageInfo.Name, Error: err.Error()})
+		}
+	}
+	for i, config := range conf.Notifications {
+		if _, err := u.NewNotifier(config); err != nil {
+			problems = append(problems, configProblem{Name: fmt.Sprintf(`notifications[%d]`, i), Error: err.Error()})
+		}
+	}
+	for _, s := range conf.Services {
+		if s.Name == `` {
+			problems = append(problems, configProblem{Error: `service without name`})
+		}
+	}
+	return
+}
+
+// runCommand executes a subcommand and returns the process exit code.
+func runCommand(conf *ServiceConfig, args []string) int {
+	var flags = flag.NewFlagSet(args[0], flag.ContinueOnError)
+	var asJson = flags.Bool(`json`, false, `print JSON`)
+	var since = flags.String(`since`, ``, `history newer than a duration or time`)
+	var eventType = flags.String(`type`, ``, `history of event types matching a pattern`)
+	var limit = flags.Int(`limit`, 0, `number of history records`)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), commandUsage)
+	}
+	var positional []string
+	for rest := args[1:]; ; rest = flags.Args()[1:] {
+		if err := flags.Parse(rest); err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+	}
+	var out = os.Stdout
+	var name string
+	if len(positional) > 0 {
+		name = positional[0]
+	}
+	var needName = map[string]bool{`check`: true, `upgrade`: true, `rollback`: true}
+	if needName[args[0]] && name == `` {
+		fmt.Fprintf(os.Stderr, "%s needs a package name\n", args[0])
+		return 2
+	}
+	var client = newControlClient(conf.Control.Socket)
+	var err error
+	switch args[0] {
+	case `status`, `pause`, `resume`:
+		var report statusReport
+		if args[0] == `status` {
+			err = client.call(http.MethodGet, `/status`, &report)
+		} else {
+			err = client.call(http.MethodPost, `/`+args[0], &report)
+		}
+		if err == nil {
+			if *asJson {
+				printJson(out, report)
+			} else {
+				printStatus(out, report)
+			}
+		}
+	case `check`, `upgrade`, `rollback`:
+		var report checkReport
+		if err = client.call(http.MethodPost, `/packages/`+url.PathEscape(name)+`/`+args[0], &report); err == nil {
+			if *asJson {
+				printJson(out, report)
+			} else {
+				printPackage(out, report)
+			}
+			if report.Error != `` {
+				return 1
+			}
+		}
+	case `history`:
+		var events []upgrader.Event
+		var query = url.Values{}
+		query.Set(`name`, name)
+		query.Set(`since`, *since)
+		query.Set(`type`, *eventType)
+		if *limit > 0 {
+			query.Set(`limit`, strconv.Itoa(*limit))
+		}
+		if err = client.call(http.MethodGet, `/events?`+query.Encode(), &events); err == nil {
+			if *asJson {
+				printJson(out, events)
+			} else {
+				printEvents(out, events)
+			}
+		}
+	case `validate-config`:
+		var problems = validateConfig(conf)
+		if *asJson {
+			printJson(out, struct {
+				Valid    bool            `json:"valid"`
+				Problems []configProblem `json:"problems"`
+			}{len(problems) == 0, problems})
+		} else if len(problems) == 0 {
+			fmt.Fprintf(out, "ok: %d services, %d packages\n", len(conf.Services), len(conf.Packages))
+		} else {
+			for _, problem := range problems {
+				fmt.Fprintf(out, "%s: %s\n", orDash(problem.Name), problem.Error)
+			}
+		}
+		if len(problems) > 0 {
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n%s", args[0], commandUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
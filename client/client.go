@@ -0,0 +1,262 @@
+// Package client lets an application cooperate with the daemon on upgrades
+// of its package that need it to shut down first (needShutdown). It finds
+// out whether an upgrade is staged, follows upgrade events, tells the daemon
+// to apply the upgrade once the application has exited, and defers
+// upgrades while the application is busy. It talks to the daemon over its
+// control socket and falls back to the upgrade.ready and upgrade.ok files
+// when the daemon cannot be reached.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExecutable   = `daemonupgrader`
+	defaultPollInterval = 10 * time.Second
+	maxEventLine        = 1 << 20
+)
+
+// Event types an application is usually interested in.
+const (
+	EventUpgradeStaged     = `upgrade.staged`
+	EventUpgradeSucceeded  = `upgrade.succeeded`
+	EventUpgradeFailed     = `upgrade.failed`
+	EventUpgradeRolledBack = `upgrade.rolledback`
+)
+
+var (
+	// ErrNotStaged is returned by Ready when no upgrade is waiting.
+	ErrNotStaged = errors.New(`no upgrade is staged for this package`)
+	// ErrUnreachable is returned when the daemon is needed but its control
+	// socket cannot be reached.
+	ErrUnreachable = errors.New(`daemon is not reachable`)
+)
+
+type Options struct {
+	// Package is the name of the application's package in the daemon's
+	// configuration.
+	Package string
+	// Directory holds the daemon's executable and its upgrade.ready and
+	// upgrade.ok files.
+	Directory string
+	// Executable is the file name of the daemon's executable, by default
+	// daemonupgrader.
+	Executable string
+	// Socket is the daemon's control socket. Like the daemon's own default
+	// it is <Executable without extension>.sock in Directory.
+	Socket string
+	// PollInterval is how often Subscribe reads upgrade.ready while the
+	// daemon cannot be reached, by default 10s.
+	PollInterval time.Duration
+}
+
+// Upgrade describes the upgrade waiting for the application.
+type Upgrade struct {
+	Version string
+	// DeferredUntil is the end of a deferral asked for with Defer. It is
+	// only known when the daemon is reachable.
+	DeferredUntil time.Time
+}
+
+// Event is an upgrade event of the package, as the daemon's history and
+// notifiers see it.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Package string    `json:"package,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type packageReply struct {
+	DeferredUntil time.Time `json:"deferredUntil,omitempty"`
+	Staged        string    `json:"staged,omitempty"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+type Client struct {
+	options Options
+	http    *http.Client
+}
+
+func New(options Options) *Client {
+	if options.Executable == `` {
+		options.Executable = defaultExecutable
+	}
+	if options.Socket == `` {
+		var name = filepath.Base(options.Executable)
+		options.Socket = filepath.Join(options.Directory, strings.TrimSuffix(name, filepath.Ext(name))+`.sock`)
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultPollInterval
+	}
+	var socket = options.Socket
+	return &Client{options: options, http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, `unix`, socket)
+		},
+	}}}
+}
+
+// request sends a request to the control socket. A daemon that is not
+// running gives an error wrapping ErrUnreachable.
+func (c *Client) request(ctx context.Context, method, path string, query url.Values) (resp *http.Response, err error) {
+	var uri = `http://daemonupgrader/packages/` + url.PathEscape(c.options.Package) + path
+	if len(query) > 0 {
+		uri += `?` + query.Encode()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, uri, nil); err != nil {
+		return
+	}
+	if resp, err = c.http.Do(req); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf(`%w: %s`, ErrUnreachable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e errorReply
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != `` {
+			if e.Error == ErrNotStaged.Error() {
+				return nil, ErrNotStaged
+			}
+			return nil, errors.New(e.Error)
+		}
+		return nil, fmt.Errorf(`unexpected status %s`, resp.Status)
+	}
+	return
+}
+
+func (c *Client) call(ctx context.Context, method, path string, query url.Values) (reply packageReply, err error) {
+	var resp *http.Response
+	if resp, err = c.request(ctx, method, path, query); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	return
+}
+
+// Staged reports the upgrade waiting until the application shuts down, if
+// any.
+func (c *Client) Staged(ctx context.Context) (upgrade Upgrade, ok bool, err error) {
+	var reply packageReply
+	if reply, err = c.call(ctx, http.MethodGet, ``, nil); errors.Is(err, ErrUnreachable) {
+		upgrade.Version, err = c.readStaged()
+	} else {
+		upgrade = Upgrade{Version: reply.Staged, DeferredUntil: reply.DeferredUntil}
+	}
+	return upgrade, err == nil && upgrade.Version != ``, err
+}
+
+// Ready tells the daemon to apply the staged upgrade once this process has
+// exited; the application should shut down right after. It also lifts a
+// deferral. Without the daemon the package is written to upgrade.ok, and the
+// daemon applies the upgrade as soon as it sees it.
+func (c *Client) Ready(ctx context.Context) (err error) {
+	var query = url.Values{`pid`: {strconv.Itoa(os.Getpid())}}
+	if _, err = c.call(ctx, http.MethodPost, `/ready`, query); errors.Is(err, ErrUnreachable) {
+		err = c.writeReady()
+	}
+	return
+}
+
+// Defer holds scheduled upgrades of the package back until the given time and
+// withdraws an earlier Ready. A zero time lifts the deferral. It needs the
+// daemon to be running.
+func (c *Client) Defer(ctx context.Context, until time.Time) (err error) {
+	var query = url.Values{}
+	if !until.IsZero() {
+		query.Set(`until`, until.Format(time.RFC3339))
+	}
+	_, err = c.call(ctx, http.MethodPost, `/defer`, query)
+	return
+}
+
+// Subscribe calls fn with the events of the package until ctx is done. While
+// the daemon cannot be reached it reads upgrade.ready every PollInterval and
+// reports an upgrade appearing there as upgrade.staged and one disappearing
+// as upgrade.succeeded. Events are also made up when the staged upgrade
+// changed while Subscribe was not connected.
+func (c *Client) Subscribe(ctx context.Context, fn func(Event)) error {
+	var staged, _, err = c.Staged(ctx)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var last = staged.Version
+	var track = func(event Event) {
+		switch event.Type {
+		case EventUpgradeStaged:
+			last = event.Version
+		case EventUpgradeSucceeded:
+			if event.Version == last {
+				last = ``
+			}
+		}
+		fn(event)
+	}
+	for {
+		err = c.stream(ctx, track)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(c.options.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if staged, _, err = c.Staged(ctx); err == nil && staged.Version != last {
+			var event = Event{Type: EventUpgradeStaged, Time: time.Now(), Package: c.options.Package, Version: staged.Version}
+			if staged.Version == `` {
+				event.Type = EventUpgradeSucceeded
+				event.Version = last
+			}
+			track(event)
+		}
+	}
+}
+
+// stream follows /events/stream until the connection ends.
+func (c *Client) stream(ctx context.Context, fn func(Event)) (err error) {
+	var query = url.Values{`name`: {c.options.Package}}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, `http://daemonupgrader/events/stream?`+query.Encode(), nil); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = c.http.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(`unexpected status %s`, resp.Status)
+	}
+	var scanner = bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 4096), maxEventLine)
+	for scanner.Scan() {
+		var event Event
+		if len(scanner.Bytes()) > 0 && json.Unmarshal(scanner.Bytes(), &event) == nil {
+			fn(event)
+		}
+	}
+	return scanner.Err()
+}
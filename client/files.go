@@ -0,0 +1,66 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	upgradeReadyFile = `upgrade.ready`
+	upgradeOkFile    = `upgrade.ok`
+)
+
+// readyInfo is the part of an upgrade.ready entry the application needs.
+type readyInfo struct {
+	Version string `json:"version"`
+}
+
+// readStaged returns the version of the package in upgrade.ready, reading it
+// under the lock the daemon takes to replace it.
+func (c *Client) readStaged() (version string, err error) {
+	var filename = filepath.Join(c.options.Directory, upgradeReadyFile)
+	if _, err = os.Stat(filename); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var unlock func()
+	if unlock, err = utils.LockFile(filename); err != nil {
+		return
+	}
+	defer unlock()
+	var staged map[string]readyInfo
+	if utils.ReadJsonFile(filename, &staged) {
+		version = staged[c.options.Package].Version
+	}
+	return
+}
+
+// writeReady adds the package to upgrade.ok if an upgrade of it is staged.
+func (c *Client) writeReady() (err error) {
+	var version string
+	if version, err = c.readStaged(); err != nil {
+		return
+	}
+	if version == `` {
+		return ErrNotStaged
+	}
+	var filename = filepath.Join(c.options.Directory, upgradeOkFile)
+	var unlock func()
+	if unlock, err = utils.LockFile(filename); err != nil {
+		return
+	}
+	defer unlock()
+	var content, _ = utils.ReadTextFile(filename)
+	var names = strings.Fields(content)
+	for _, name := range names {
+		if name == c.options.Package {
+			return
+		}
+	}
+	return utils.WriteTextFile(filename, strings.Join(append(names, c.options.Package), "\n")+"\n")
+}
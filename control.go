@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	defaultControlMode = 0600
+	defaultEventLimit  = 200
+)
+
+var (
+	errUnknownPackage = errors.New(`unknown package`)
+	errNoHistory      = errors.New(`history is not available`)
+)
+
+type ControlConfig struct {
+	Socket   string `yaml:"socket,omitempty"`
+	Mode     string `yaml:"mode,omitempty"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+}
+
+func (c ControlConfig) mode() os.FileMode {
+	if mode, err := strconv.ParseUint(c.Mode, 8, 32); err == nil && mode > 0 {
+		return os.FileMode(mode) & os.ModePerm
+	}
+	return defaultControlMode
+}
+
+type serviceReport struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Status   string `json:"status"`
+	Task     string `json:"task,omitempty"`
+}
+
+type packageReport struct {
+	Name          string    `json:"name"`
+	Interval      string    `json:"interval"`
+	LocalVersion  string    `json:"localVersion,omitempty"`
+	RemoteVersion string    `json:"remoteVersion,omitempty"`
+	LastCheck     time.Time `json:"lastCheck,omitempty"`
+	LastUpgrade   time.Time `json:"lastUpgrade,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextCheck     time.Time `json:"nextCheck,omitempty"`
+	DeferredUntil time.Time `json:"deferredUntil,omitempty"`
+	Staged        string    `json:"staged,omitempty"`
+	Task          string    `json:"task,omitempty"`
+}
+
+type checkReport struct {
+	packageReport
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+type statusReport struct {
+	Version  string          `json:"version"`
+	Started  time.Time       `json:"started"`
+	Paused   bool            `json:"paused"`
+	Services []serviceReport `json:"services"`
+	Packages []packageReport `json:"packages"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+func (p *program) taskName(key string) string {
+	if status, ok := p.tasks.Load(key); ok {
+		return status.(PackageStatus).String()
+	}
+	return ``
+}
+
+func (p *program) status() (report statusReport) {
+	report.Version = version.BuildVersion
+	report.Started = p.started
+	report.Paused = p.upgrader.State().IsPaused()
+	report.Services = make([]serviceReport, 0, len(p.services))
+	for _, s := range p.services {
+		var item = serviceReport{Name: s.Name, Interval: s.Interval.String(), Status: `unknown`, Task: p.taskName(serviceTaskKey(s.Name))}
+		if srv, err := service.New(&program{}, &service.Config{Name: s.Name}); err == nil {
+			if status, err := srv.Status(); err == nil {
+				switch status {
+				case service.StatusRunning:
+					item.Status = `running`
+				case service.StatusStopped:
+					item.Status = `stopped`
+				}
+			} else if err == service.ErrNotInstalled {
+				item.Status = `not installed`
+			}
+		}
+		report.Services = append(report.Services, item)
+	}
+	report.Packages = make([]packageReport, 0, len(p.packages))
+	for _, s := range p.packages {
+		var item = packageReport{Name: s.Name, Interval: s.Interval.String(), Task: p.taskName(packageTaskKey(s.Name))}
+		if state, ok := p.upgrader.State().Get(s.Name); ok {
+			item.LocalVersion = state.LocalVersion
+			item.RemoteVersion = state.RemoteVersion
+			item.LastCheck = state.LastCheck
+			item.LastUpgrade = state.LastUpgrade
+			item.LastError = state.LastError
+			item.NextCheck = state.NextCheck
+			item.DeferredUntil = state.DeferredUntil
+		}
+		if info, ok := p.upgrader.Staged(s.Name); ok {
+			item.Staged = info.Version
+		}
+		report.Packages = append(report.Packages, item)
+	}
+	return
+}
+
+func (p *program) findPackage(name string) *upgrader.Package {
+	for _, s := range p.packages {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, errorReply{Error: err.Error()})
+}
+
+func (p *program) controlHandler() http.Handler {
+	var mux = http.NewServeMux()
+	mux.HandleFunc(`/status`, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, p.status())
+	})
+	mux.HandleFunc(`/events`, p.handleEvents)
+	mux.HandleFunc(`/events/stream`, p.handleEventStream)
+	for path, paused := range map[string]bool{`/pause`: true, `/resume`: false} {
+		var paused = paused
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			p.setPaused(paused)
+			writeJson(w, http.StatusOK, p.status())
+		})
+	}
+	mux.HandleFunc(`/packages/`, p.handlePackage)
+	return mux
+}
+
+// handleEvents serves GET /events?name=&type=&since=&limit= from the history.
+func (p *program) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if p.history == nil {
+		writeError(w, http.StatusServiceUnavailable, errNoHistory)
+		return
+	}
+	var values = r.URL.Query()
+	var q = historyQuery{Name: values.Get(`name`), Type: values.Get(`type`), Limit: defaultEventLimit}
+	if limit, err := strconv.Atoi(values.Get(`limit`)); err == nil {
+		q.Limit = limit
+	}
+	var err error
+	if q.Since, err = parseSince(values.Get(`since`)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var events []upgrader.Event
+	if events, err = p.history.query(q); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, events)
+}
+
+// parseUntil accepts a time in RFC 3339 or a duration counted from now, such
+// as 2h. An empty value gives the zero time.
+func parseUntil(value string) (time.Time, error) {
+	if value == `` {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d), nil
+	}
+	var t, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf(`invalid until: %s`, value)
+	}
+	return t, nil
+}
+
+// handlePackage serves GET /packages/<name> and POST
+// /packages/<name>/<action>. Every action runs synchronously and replies with
+// the package's status afterwards, with status 500 when the action failed.
+func (p *program) handlePackage(w http.ResponseWriter, r *http.Request) {
+	var parts = strings.Split(strings.TrimPrefix(r.URL.Path, `/packages/`), `/`)
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 && r.Method != http.MethodGet || len(parts) == 2 && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var packageInfo = p.findPackage(parts[0])
+	if packageInfo == nil {
+		writeError(w, http.StatusNotFound, errUnknownPackage)
+		return
+	}
+	var err error
+	var available bool
+	var action string
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch action {
+	case ``:
+	case `ready`:
+		var pid, _ = strconv.Atoi(r.URL.Query().Get(`pid`))
+		err = p.ready(packageInfo.Name, pid)
+	case `defer`:
+		var until time.Time
+		if until, err = parseUntil(r.URL.Query().Get(`until`)); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = p.deferUpgrade(packageInfo.Name, until)
+	case `check`:
+		available, err = p.checkOnly(packageInfo)
+	case `upgrade`:
+		err = p.upgradeNow(packageInfo)
+	case `apply`:
+		err = p.applyNow(packageInfo)
+	case `rollback`:
+		err = p.rollback(packageInfo)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case err == errTaskRunning:
+		writeError(w, http.StatusConflict, err)
+		return
+	case err == errNotStaged:
+		writeError(w, http.StatusNotFound, err)
+		return
+	case upgrader.IsCancelled(err):
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	for _, item := range p.status().Packages {
+		if item.Name == packageInfo.Name {
+			var report = checkReport{packageReport: item, Available: available}
+			var code = http.StatusOK
+			if err != nil {
+				report.Error = err.Error()
+				code = http.StatusInternalServerError
+			}
+			writeJson(w, code, report)
+		}
+	}
+}
+
+// checkOnly looks for a newer release of packageInfo without installing it.
+func (p *program) checkOnly(packageInfo *upgrader.Package) (available bool, err error) {
+	var key = packageTaskKey(packageInfo.Name)
+	if !p.tryStartTask(key, checkUpgrade) {
+		return false, errTaskRunning
+	}
+	defer p.finishTask(key)
+	p.wg.Add(1)
+	defer p.wg.Done()
+	_, available, err = p.upgrader.Check(p.ctx, packageInfo)
+	return
+}
+
+// applyNow applies the staged upgrade of packageInfo without waiting for the
+// application to ask for it.
+func (p *program) applyNow(packageInfo *upgrader.Package) error {
+	p.wg.Add(1)
+	defer p.wg.Done()
+	return p.upgradePackage(packageInfo.Name)
+}
+
+func (p *program) rollback(packageInfo *upgrader.Package) (err error) {
+	var key = packageTaskKey(packageInfo.Name)
+	if !p.tryStartTask(key, upgradeOk) {
+		return errTaskRunning
+	}
+	defer p.finishTask(key)
+	p.wg.Add(1)
+	defer p.wg.Done()
+	if _, err = p.upgrader.Rollback(p.ctx, packageInfo); err != nil {
+		logger.Log(logging.Error, `rollback failed`, logging.Fields{Package: packageInfo.Name, Phase: `rollback`, Error: err.Error()})
+	}
+	p.saveState()
+	return
+}
+
+// upgradeNow runs an upgrade of packageInfo right away, ignoring pauses,
+// jitter and any back-off requested by the update server.
+func (p *program) upgradeNow(packageInfo *upgrader.Package) error {
+	var key = packageTaskKey(packageInfo.Name)
+	if !p.tryStartTask(key, checkUpgrade) {
+		return errTaskRunning
+	}
+	defer p.finishTask(key)
+	p.wg.Add(1)
+	defer p.wg.Done()
+	return p.runUpgrade(packageInfo)
+}
+
+func (p *program) setPaused(paused bool) {
+	p.upgrader.State().SetPaused(paused)
+	if paused {
+		logger.Log(logging.Info, `automatic upgrades paused`, logging.Fields{})
+	} else {
+		logger.Log(logging.Info, `automatic upgrades resumed`, logging.Fields{})
+	}
+	p.saveState()
+}
+
+func (p *program) startControl() (err error) {
+	if p.control.Disabled {
+		return
+	}
+	var listener net.Listener
+	if listener, err = utils.ListenSocket(p.control.Socket, p.control.mode()); err != nil {
+		return
+	}
+	p.controlServer = &http.Server{Handler: p.controlHandler()}
+	go func() {
+		if err := p.controlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Log(logging.Error, `control server stopped`, logging.Fields{Error: err.Error()})
+		}
+	}()
+	return
+}
+
+func (p *program) stopControl() {
+	if p.controlServer == nil {
+		return
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = p.controlServer.Shutdown(ctx)
+	_ = os.Remove(p.control.Socket)
+}
@@ -2,150 +2,275 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
-	"net/url"
+	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kardianos/service"
 
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
 	"github.com/vrherog/daemonupgrader/utils"
-	"github.com/vrherog/daemonupgrader/version"
 )
 
-type UpgradeReadyInfo struct {
-	WorkDirectory string `json:"workDirectory"`
-	PackageDir    string `json:"package_dir"`
-	Version       string `json:"version"`
-}
+var (
+	errTaskRunning = errors.New(`another task of this package is running`)
+	errNotStaged   = errors.New(`no upgrade is staged for this package`)
+)
 
-func (p *program) checkServiceStatus(name string) {
-	p.tasks.Store(name, checkServiceStatus)
+func (p *program) checkServiceStatus(s ServiceInfo) {
+	var name = s.Name
+	var key = serviceTaskKey(name)
+	if !p.tryStartTask(key, checkServiceStatus) {
+		return
+	}
+	defer p.finishTask(key)
+	if !p.upgrader.Checks.Acquire(p.ctx) {
+		return
+	}
+	defer p.upgrader.Checks.Release()
+	var probe = probeError
+	defer func() { p.metrics.probe(name, probe) }()
 	if srv, err := service.New(&program{}, &service.Config{Name: name}); err == nil {
 		if status, err := srv.Status(); err == nil {
-			if status == service.StatusStopped {
+			if status == service.StatusRunning {
+				probe = probeRunning
+				p.resetRestarts(name)
+			} else if status == service.StatusStopped {
+				probe = probeStopped
+				if p.giveUp(s) {
+					return
+				}
 				if err = srv.Start(); err != nil {
-					_ = logger.Errorf(`start service %s %s`, name, err)
+					logger.Log(logging.Error, `start service failed`, logging.Fields{Service: name, Error: err.Error()})
+				} else {
+					logger.Log(logging.Info, `service restarted`, logging.Fields{Service: name})
+					p.upgrader.Notify(upgrader.Event{Type: upgrader.EventServiceRestarted, Service: name})
 				}
 			}
 		}
 	}
-	p.tasks.Delete(name)
 }
 
-func (p *program) checkUpgrade(packageInfo UpgradePackageInfo) {
-	p.tasks.Store(packageInfo.Name, checkUpgrade)
-	var err error
-	var dirInfo os.FileInfo
-	if dirInfo, err = os.Stat(packageInfo.WorkDirectory); (err == nil || os.IsExist(err)) && dirInfo.IsDir() {
-		var urlPackage *url.URL
-		urlPackage, err = url.Parse(packageInfo.UriDownloadPackage)
-		if err == nil {
-			var parts = strings.Split(urlPackage.Path, `/`)
-			if len(parts) > 0 {
-				var filename = parts[len(parts)-1]
-				var packageType = filepath.Ext(filename)
-				var remoteVer, localVer string
-				if remoteVer, _, err = utils.RequestText(packageInfo.UriCheckVersion, `GET`, ``); err == nil && remoteVer != `` {
-					if localVer, err = utils.ExecCommandString(packageInfo.CommandGetVersion); err == nil && localVer != `` {
-						if comp, ok := version.CompareVersion(remoteVer, strings.TrimSpace(string(localVer))); ok && comp == 1 {
-							var upgradeReadyInfo map[string]UpgradeReadyInfo
-							if ok = utils.ReadJsonFile(upgradeReadyFile, &upgradeReadyInfo); !ok {
-								upgradeReadyInfo = make(map[string]UpgradeReadyInfo)
-							}
-							var notReady = true
-							if info, ok := upgradeReadyInfo[packageInfo.Name]; ok {
-								if comp, ok := version.CompareVersion(info.Version, remoteVer); ok && comp >= 0 {
-									notReady = false
-								}
-							}
-							if notReady {
-								var tempDir string
-								tempDir, err = ioutil.TempDir(os.TempDir(), `upgrade`)
-								if err != nil {
-									tempDir = os.TempDir()
-								}
-								var packageFile = filepath.Join(os.TempDir(), filename)
-								if _, err = utils.DownloadFile(packageFile, packageInfo.UriDownloadPackage, `GET`, ``); err == nil {
-									_ = logger.Infof(`find new version: %s`, packageInfo.Name)
-									switch packageType {
-									case `.zip`:
-										err = utils.Unzip(packageFile, tempDir)
-									case `.gz`:
-										err = utils.ExtractGzip(packageFile, tempDir)
-									default:
-										err = errors.New(`not supported type`)
-									}
-									if err == nil {
-										_ = os.Remove(packageFile)
-										_ = logger.Infof(`new version download completed:%s %s`, packageInfo.Name, tempDir)
-										if packageInfo.NeedShutdown {
-											upgradeReadyInfo[packageInfo.Name] = UpgradeReadyInfo{
-												WorkDirectory: packageInfo.WorkDirectory,
-												PackageDir:    tempDir,
-												Version:       remoteVer,
-											}
-											if err = utils.WriteJsonFile(upgradeReadyFile, upgradeReadyInfo); err == nil {
-												_ = logger.Infof(`upgrade ready: %s`, packageInfo.Name)
-											}
-										} else {
-											if err = utils.CopyFiles(tempDir, packageInfo.WorkDirectory); err == nil {
-												err = os.RemoveAll(tempDir)
-												_ = logger.Infof(`upgrade completed: %s`, packageInfo.Name)
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
+// restartHistory holds the recent restarts of a service. Each service is
+// checked by one task at a time, so it needs no locking.
+type restartHistory struct {
+	times  []time.Time
+	gaveUp bool
+}
+
+// giveUp records a restart attempt of s and reports whether s has been
+// restarted maxRestarts times within restartWindow, in which case it is left
+// stopped until it is found running again.
+func (p *program) giveUp(s ServiceInfo) bool {
+	if s.MaxRestarts <= 0 {
+		return false
+	}
+	var value, _ = p.restarts.LoadOrStore(s.Name, &restartHistory{})
+	var history = value.(*restartHistory)
+	if history.gaveUp {
+		return true
+	}
+	var now = time.Now()
+	var times = history.times[:0]
+	for _, t := range history.times {
+		if now.Sub(t) < s.RestartWindow {
+			times = append(times, t)
 		}
 	}
+	history.times = times
+	if len(history.times) >= s.MaxRestarts {
+		history.gaveUp = true
+		var message = fmt.Sprintf(`restarted %d times within %s`, len(history.times), s.RestartWindow)
+		logger.Log(logging.Warning, `giving up restarting service`, logging.Fields{Service: s.Name, Error: message})
+		p.upgrader.Notify(upgrader.Event{Type: upgrader.EventServiceGaveUp, Service: s.Name, Error: message})
+		return true
+	}
+	history.times = append(history.times, now)
+	return false
+}
+
+func (p *program) resetRestarts(name string) {
+	if value, ok := p.restarts.Load(name); ok && value.(*restartHistory).gaveUp {
+		p.restarts.Delete(name)
+	}
+}
+
+func (p *program) checkUpgrade(packageInfo *upgrader.Package) {
+	var key = packageTaskKey(packageInfo.Name)
+	if !p.tryStartTask(key, checkUpgrade) {
+		return
+	}
+	defer p.finishTask(key)
+	if p.upgrader.State().IsPaused() || !p.upgrader.WaitDue(p.ctx, packageInfo) {
+		return
+	}
+	_ = p.runUpgrade(packageInfo)
+}
+
+func (p *program) runUpgrade(packageInfo *upgrader.Package) (err error) {
+	err = p.upgrader.Upgrade(p.ctx, packageInfo)
+	if upgrader.IsCancelled(err) || p.ctx.Err() != nil {
+		return
+	}
 	if err != nil {
-		_ = logger.Error(err)
+		logger.Log(logging.Error, `upgrade failed`, logging.Fields{Package: packageInfo.Name, Error: err.Error()})
 	}
-	p.tasks.Delete(packageInfo.Name)
+	p.saveState()
+	return
 }
 
-func (p *program) upgradePackage(name string) {
-	p.tasks.Store(name, upgradeOk)
-	var upgradeReadyInfo map[string]UpgradeReadyInfo
-	var err error
-	if ok := utils.ReadJsonFile(upgradeReadyFile, &upgradeReadyInfo); ok {
-		if info, ok := upgradeReadyInfo[name]; ok {
-			if err = utils.CopyFiles(info.PackageDir, info.WorkDirectory); err == nil {
-				err = os.RemoveAll(info.PackageDir)
-				if content, ok := utils.ReadTextFile(upgradeOkFile); ok {
-					var buffer = make([]string, 0)
-					for _, item := range strings.Fields(content) {
-						if item != name {
-							buffer = append(buffer, item)
-						}
-					}
-					if len(buffer) > 0 {
-						if err = utils.WriteTextFile(upgradeOkFile, strings.Join(buffer, `\n`)); err == nil {
-							_ = logger.Infof(`upgrade completed: %s`, name)
-						}
-					} else {
-						if err = os.Remove(upgradeOkFile); err == nil {
-							_ = logger.Infof(`upgrade completed: %s`, name)
-						}
-					}
-					delete(upgradeReadyInfo, name)
-					if len(upgradeReadyInfo) > 0 {
-						err = utils.WriteJsonFile(upgradeReadyFile, upgradeReadyInfo)
-					} else {
-						err = os.Remove(upgradeReadyFile)
-					}
-				}
-			}
+func (p *program) saveState() {
+	if err := p.upgrader.State().Save(); err != nil {
+		logger.Log(logging.Error, `save state failed`, logging.Fields{Error: err.Error()})
+	}
+}
+
+func (p *program) checkUpgradeOk() {
+	for _, name := range readUpgradeOk() {
+		if p.stillExiting(name) {
+			continue
+		}
+		if info, ok := p.upgrader.Staged(name); ok && time.Now().Before(info.RetryAt) {
+			continue
 		}
+		if _, ok := p.tasks.Load(packageTaskKey(name)); !ok {
+			p.wg.Add(1)
+			go func(name string) {
+				defer p.wg.Done()
+				_ = p.upgradePackage(name)
+			}(name)
+		}
+	}
+}
+
+// readUpgradeOk returns the packages that applications have marked ready to
+// be replaced in upgrade.ok.
+func readUpgradeOk() (names []string) {
+	if _, err := os.Stat(upgradeOkFile); err != nil {
+		return
 	}
+	var unlock, err = utils.LockFile(upgradeOkFile)
 	if err != nil {
-		_ = logger.Error(err)
+		logger.Log(logging.Error, `lock `+upgradeOkFile+` failed`, logging.Fields{Error: err.Error()})
+		return
+	}
+	defer unlock()
+	if content, ok := utils.ReadTextFile(upgradeOkFile); ok {
+		names = strings.Fields(content)
+	}
+	return
+}
+
+// addUpgradeOk appends name to upgrade.ok unless it is listed already.
+func addUpgradeOk(name string) (err error) {
+	var unlock func()
+	if unlock, err = utils.LockFile(upgradeOkFile); err != nil {
+		return
+	}
+	defer unlock()
+	var content, _ = utils.ReadTextFile(upgradeOkFile)
+	var names = strings.Fields(content)
+	for _, item := range names {
+		if item == name {
+			return
+		}
+	}
+	return utils.WriteTextFile(upgradeOkFile, strings.Join(append(names, name), "\n")+"\n")
+}
+
+// removeUpgradeOk removes name from upgrade.ok, deleting the file once it is
+// empty.
+func removeUpgradeOk(name string) (err error) {
+	var unlock func()
+	if unlock, err = utils.LockFile(upgradeOkFile); err != nil {
+		return
+	}
+	defer unlock()
+	var content, ok = utils.ReadTextFile(upgradeOkFile)
+	if !ok {
+		return
+	}
+	var buffer = make([]string, 0)
+	for _, item := range strings.Fields(content) {
+		if item != name {
+			buffer = append(buffer, item)
+		}
+	}
+	if len(buffer) > 0 {
+		return utils.WriteTextFile(upgradeOkFile, strings.Join(buffer, "\n")+"\n")
+	}
+	return os.Remove(upgradeOkFile)
+}
+
+// stillExiting reports whether the application that declared itself ready
+// for the staged upgrade of name is still running.
+func (p *program) stillExiting(name string) bool {
+	if pid, ok := p.exiting.Load(name); ok {
+		if utils.ProcessRunning(pid.(int)) {
+			return true
+		}
+		p.exiting.Delete(name)
+	}
+	return false
+}
+
+// ready has the staged upgrade of name applied once the application, whose
+// process id is pid, has exited, or right away when pid is 0. It lifts any
+// deferral.
+func (p *program) ready(name string, pid int) error {
+	if _, ok := p.upgrader.Staged(name); !ok {
+		return errNotStaged
+	}
+	if pid > 0 {
+		p.exiting.Store(name, pid)
+	} else {
+		p.exiting.Delete(name)
+	}
+	p.upgrader.State().Update(name, func(state *upgrader.PackageState) {
+		state.DeferredUntil = time.Time{}
+	})
+	p.saveState()
+	logger.Log(logging.Info, `application ready for upgrade`, logging.Fields{Package: name, Phase: `install`})
+	return addUpgradeOk(name)
+}
+
+// deferUpgrade holds scheduled upgrades of name back until the given time and
+// withdraws an earlier ready; a zero time lifts the deferral.
+func (p *program) deferUpgrade(name string, until time.Time) error {
+	p.upgrader.State().Update(name, func(state *upgrader.PackageState) {
+		state.DeferredUntil = until
+	})
+	p.saveState()
+	p.exiting.Delete(name)
+	if until.IsZero() {
+		logger.Log(logging.Info, `upgrade deferral lifted`, logging.Fields{Package: name})
+	} else {
+		logger.Log(logging.Info, `upgrades deferred until `+until.Format(time.RFC3339), logging.Fields{Package: name})
+	}
+	return removeUpgradeOk(name)
+}
+
+func (p *program) upgradePackage(name string) (err error) {
+	var key = packageTaskKey(name)
+	if !p.tryStartTask(key, upgradeOk) {
+		return errTaskRunning
+	}
+	defer p.finishTask(key)
+	var applied bool
+	applied, err = p.upgrader.ApplyStaged(p.ctx, name)
+	if applied {
+		p.exiting.Delete(name)
+		if e := removeUpgradeOk(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil && !upgrader.IsCancelled(err) {
+		logger.Log(logging.Error, `apply staged upgrade failed`, logging.Fields{Package: name, Phase: `install`, Error: err.Error()})
+	}
+	if err == nil && !applied {
+		err = errNotStaged
 	}
-	p.tasks.Delete(name)
+	return
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	defaultHistoryMaxAge     = 90 * 24 * time.Hour
+	defaultHistoryMaxRecords = 10000
+	historyMaxLine           = 1 << 20
+	historyQueue             = 1000
+)
+
+type HistoryConfig struct {
+	File       string        `yaml:"file,omitempty"`
+	MaxAge     time.Duration `yaml:"maxAge,omitempty"`
+	MaxRecords int           `yaml:"maxRecords,omitempty"`
+}
+
+// historyQuery selects records of one package or service, of types matching
+// a pattern such as upgrade.*, newer than since; limit keeps the newest.
+type historyQuery struct {
+	Name  string
+	Type  string
+	Since time.Time
+	Limit int
+}
+
+// parseSince accepts a time in RFC 3339 or a duration counted back from now,
+// such as 24h.
+func parseSince(value string) (time.Time, error) {
+	if value == `` {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	var t, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf(`invalid since: %s`, value)
+	}
+	return t, nil
+}
+
+func (q historyQuery) match(event upgrader.Event) bool {
+	if q.Name != `` && event.Package != q.Name && event.Service != q.Name {
+		return false
+	}
+	if q.Type != `` {
+		if ok, _ := path.Match(q.Type, string(event.Type)); !ok {
+			return false
+		}
+	}
+	return !event.Time.Before(q.Since)
+}
+
+// history is an append-only file of events, one JSON object per line. Once
+// it holds a tenth more than maxRecords records, or its oldest record is a
+// day past maxAge, it is rewritten without the records beyond the limits.
+// Records are queued and written by a single goroutine, so that Notify does
+// not wait for the disk; when the queue is full new records are dropped.
+type history struct {
+	mutex      sync.Mutex
+	filename   string
+	maxAge     time.Duration
+	maxRecords int
+	file       *os.File
+	count      int
+	oldest     time.Time
+	queue      chan upgrader.Event
+	closed     bool
+	done       chan struct{}
+}
+
+func openHistory(config HistoryConfig) (h *history, err error) {
+	h = &history{filename: config.File, maxAge: config.MaxAge, maxRecords: config.MaxRecords}
+	if h.maxAge <= 0 {
+		h.maxAge = defaultHistoryMaxAge
+	}
+	if h.maxRecords <= 0 {
+		h.maxRecords = defaultHistoryMaxRecords
+	}
+	if err = h.compact(); err != nil {
+		return nil, err
+	}
+	h.queue = make(chan upgrader.Event, historyQueue)
+	h.done = make(chan struct{})
+	go h.run()
+	return
+}
+
+// read returns every well-formed record; a line cut short by a crash is
+// skipped and reported as damaged.
+func (h *history) read() (events []upgrader.Event, damaged bool, err error) {
+	var file *os.File
+	if file, err = os.Open(h.filename); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+	var scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), historyMaxLine)
+	for scanner.Scan() {
+		var event upgrader.Event
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			events = append(events, event)
+		} else {
+			damaged = true
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// compact rewrites the file without expired records and reopens it for
+// appending. A damaged file is rewritten too, so that the next record is not
+// appended to a torn line. The caller holds the mutex or has not shared h yet.
+func (h *history) compact() (err error) {
+	if h.file != nil {
+		_ = h.file.Close()
+		h.file = nil
+	}
+	var events []upgrader.Event
+	var damaged bool
+	if events, damaged, err = h.read(); err != nil {
+		return
+	}
+	var cutoff = time.Now().Add(-h.maxAge)
+	var first = 0
+	for first < len(events) && events[first].Time.Before(cutoff) {
+		first++
+	}
+	if len(events)-first > h.maxRecords {
+		first = len(events) - h.maxRecords
+	}
+	if first > 0 || damaged {
+		var content []byte
+		for _, event := range events[first:] {
+			var line, _ = json.Marshal(event)
+			content = append(append(content, line...), '\n')
+		}
+		if err = utils.WriteFileAtomic(h.filename, content, 0644); err != nil {
+			return
+		}
+		events = events[first:]
+	}
+	h.count = len(events)
+	h.oldest = time.Time{}
+	if len(events) > 0 {
+		h.oldest = events[0].Time
+	}
+	h.file, err = os.OpenFile(h.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return
+}
+
+func (h *history) Notify(event upgrader.Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.queue <- event:
+	default:
+		logger.Log(logging.Warning, `history queue full, dropped `+string(event.Type), logging.Fields{Package: event.Package, Service: event.Service})
+	}
+}
+
+func (h *history) run() {
+	defer close(h.done)
+	for event := range h.queue {
+		h.mutex.Lock()
+		h.write(event)
+		h.mutex.Unlock()
+	}
+}
+
+// write appends event and compacts the file when it has grown past the
+// limits. The caller holds the mutex.
+func (h *history) write(event upgrader.Event) {
+	if h.file == nil {
+		return
+	}
+	var line, err = json.Marshal(event)
+	if err == nil {
+		if _, err = h.file.Write(append(line, '\n')); err == nil {
+			err = h.file.Sync()
+		}
+	}
+	if err != nil {
+		logger.Log(logging.Error, `write history failed`, logging.Fields{Error: err.Error()})
+		return
+	}
+	h.count++
+	if h.oldest.IsZero() {
+		h.oldest = event.Time
+	}
+	if h.count > h.maxRecords+h.maxRecords/10 || time.Since(h.oldest) > h.maxAge+24*time.Hour {
+		if err = h.compact(); err != nil {
+			logger.Log(logging.Error, `compact history failed`, logging.Fields{Error: err.Error()})
+		}
+	}
+}
+
+// query returns the matching records, oldest first.
+func (h *history) query(q historyQuery) (events []upgrader.Event, err error) {
+	h.mutex.Lock()
+	var all []upgrader.Event
+	all, _, err = h.read()
+	h.mutex.Unlock()
+	events = make([]upgrader.Event, 0)
+	for _, event := range all {
+		if q.match(event) {
+			events = append(events, event)
+		}
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return
+}
+
+// Close writes the queued records and closes the file.
+func (h *history) Close() error {
+	h.mutex.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mutex.Unlock()
+	<-h.done
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	var err = h.file.Close()
+	h.file = nil
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/upgrader"
+)
+
+func writeHistory(t *testing.T, filename string, events []upgrader.Event, tail string) {
+	var content []byte
+	for _, event := range events {
+		var line, _ = json.Marshal(event)
+		content = append(append(content, line...), '\n')
+	}
+	if err := ioutil.WriteFile(filename, append(content, tail...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func versions(events []upgrader.Event) (list []string) {
+	for _, event := range events {
+		list = append(list, event.Version)
+	}
+	return
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), `history.jsonl`)
+	var now = time.Now()
+	var events []upgrader.Event
+	for i, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, 5 * time.Hour, 4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+		events = append(events, upgrader.Event{Type: upgrader.EventUpgradeSucceeded, Time: now.Add(-age), Package: `app`, Version: string(rune('a' + i))})
+	}
+	writeHistory(t, filename, events, `{"type":"upgrade.succ`)
+
+	var h, err = openHistory(HistoryConfig{File: filename, MaxAge: 24 * time.Hour, MaxRecords: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []upgrader.Event
+	if got, _, err = h.read(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`d`, `e`, `f`, `g`}; !equalStrings(versions(got), want) {
+		t.Errorf(`after open the history holds %v, want %v`, versions(got), want)
+	}
+
+	h.Notify(upgrader.Event{Type: upgrader.EventUpgradeSucceeded, Time: now, Package: `app`, Version: `h`})
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err = h.read(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`e`, `f`, `g`, `h`}; !equalStrings(versions(got), want) {
+		t.Errorf(`after a write past maxRecords the history holds %v, want %v`, versions(got), want)
+	}
+	h.Notify(upgrader.Event{Type: upgrader.EventUpgradeSucceeded, Time: now, Package: `app`, Version: `i`})
+	if got, _, _ = h.read(); len(got) != 4 {
+		t.Errorf(`a record was written after Close`)
+	}
+}
+
+func TestHistoryTornTail(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), `history.jsonl`)
+	var now = time.Now()
+	writeHistory(t, filename, []upgrader.Event{
+		{Type: upgrader.EventUpgradeStarted, Time: now.Add(-time.Hour), Package: `app`, Version: `a`},
+	}, `{"type":"upgrade.succ`)
+	var h, err = openHistory(HistoryConfig{File: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Notify(upgrader.Event{Type: upgrader.EventUpgradeSucceeded, Time: now, Package: `app`, Version: `b`})
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got []upgrader.Event
+	var damaged bool
+	if got, damaged, err = h.read(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`a`, `b`}; damaged || !equalStrings(versions(got), want) {
+		t.Errorf(`history holds %v, damaged %t, want %v`, versions(got), damaged, want)
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), `history.jsonl`)
+	var now = time.Now()
+	writeHistory(t, filename, []upgrader.Event{
+		{Type: upgrader.EventCheckSucceeded, Time: now.Add(-3 * time.Hour), Package: `app`, Version: `1`},
+		{Type: upgrader.EventUpgradeStarted, Time: now.Add(-2 * time.Hour), Package: `app`, Version: `2`},
+		{Type: upgrader.EventUpgradeFailed, Time: now.Add(-2 * time.Hour), Package: `other`, Version: `3`},
+		{Type: upgrader.EventServiceRestarted, Time: now.Add(-time.Hour), Service: `app`, Version: `4`},
+		{Type: upgrader.EventUpgradeSucceeded, Time: now, Package: `app`, Version: `5`},
+	}, ``)
+	var h, err = openHistory(HistoryConfig{File: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var tests = []struct {
+		name  string
+		query historyQuery
+		want  []string
+	}{
+		{`everything`, historyQuery{}, []string{`1`, `2`, `3`, `4`, `5`}},
+		{`package or service name`, historyQuery{Name: `app`}, []string{`1`, `2`, `4`, `5`}},
+		{`type pattern`, historyQuery{Type: `upgrade.*`}, []string{`2`, `3`, `5`}},
+		{`since`, historyQuery{Since: now.Add(-90 * time.Minute)}, []string{`4`, `5`}},
+		{`limit keeps the newest`, historyQuery{Name: `app`, Limit: 2}, []string{`4`, `5`}},
+		{`nothing matches`, historyQuery{Name: `none`}, nil},
+	}
+	for _, test := range tests {
+		var got, err = h.query(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(versions(got), test.want) {
+			t.Errorf(`%s: got %v, want %v`, test.name, versions(got), test.want)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	var got, err = parseSince(`24h`)
+	if err != nil || time.Since(got) < 24*time.Hour || time.Since(got) > 24*time.Hour+time.Minute {
+		t.Errorf(`parseSince(24h) = %v, %v`, got, err)
+	}
+	if got, err = parseSince(`2024-01-02T03:04:05Z`); err != nil || !got.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf(`parseSince of an RFC 3339 time = %v, %v`, got, err)
+	}
+	if got, err = parseSince(``); err != nil || !got.IsZero() {
+		t.Errorf(`parseSince of nothing = %v, %v`, got, err)
+	}
+	if _, err = parseSince(`yesterday`); err == nil {
+		t.Errorf(`parseSince(yesterday) did not fail`)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
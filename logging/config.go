@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"fmt"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+type Config struct {
+	Level  Level        `yaml:"level,omitempty"`
+	Format Format       `yaml:"format,omitempty"`
+	File   FileConfig   `yaml:"file,omitempty"`
+	Syslog SyslogConfig `yaml:"syslog,omitempty"`
+}
+
+type FileConfig struct {
+	Path     string         `yaml:"path,omitempty"`
+	MaxSize  utils.ByteSize `yaml:"maxSize,omitempty"`
+	MaxFiles int            `yaml:"maxFiles,omitempty"`
+	Disabled bool           `yaml:"disabled,omitempty"`
+}
+
+type SyslogConfig struct {
+	Enabled bool   `yaml:"enabled,omitempty"`
+	Address string `yaml:"address,omitempty"`
+	Tag     string `yaml:"tag,omitempty"`
+}
+
+// Open creates the logger described by config. Entries are also forwarded
+// to service unless it is nil. A sink that cannot be opened is reported
+// through onError and left out.
+func Open(config Config, service ServiceLogger, onError func(error)) (*Logger, error) {
+	if onError == nil {
+		onError = func(error) {}
+	}
+	switch config.Format {
+	case ``:
+		config.Format = FormatText
+	case FormatText, FormatJson:
+	default:
+		return nil, fmt.Errorf(`unknown log format: %s`, config.Format)
+	}
+	var sinks []Sink
+	if service != nil {
+		sinks = append(sinks, NewServiceSink(service))
+	}
+	if !config.File.Disabled && config.File.Path != `` {
+		if sink, err := NewFileSink(config.File.Path, config.Format, int64(config.File.MaxSize), config.File.MaxFiles); err != nil {
+			onError(fmt.Errorf(`log file %s: %s`, config.File.Path, err))
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	if config.Syslog.Enabled {
+		if sink, err := NewSyslogSink(config.Syslog.Address, config.Syslog.Tag, config.Format); err != nil {
+			onError(fmt.Errorf(`syslog: %s`, err))
+		} else {
+			sinks = append(sinks, sink)
+		}
+	}
+	return New(config.Level, onError, sinks...), nil
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	defaultMaxSize  = 10 << 20
+	defaultMaxFiles = 5
+)
+
+// fileSink appends to filename and rotates it once it would grow past
+// maxSize: filename becomes filename.1, filename.1 becomes filename.2 and so
+// on, keeping maxFiles old files.
+type fileSink struct {
+	mutex    sync.Mutex
+	filename string
+	format   Format
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(filename string, format Format, maxSize int64, maxFiles int) (Sink, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+	var s = &fileSink{filename: filename, format: format, maxSize: maxSize, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() (err error) {
+	if s.file, err = os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = s.file.Stat(); err == nil {
+		s.size = info.Size()
+	}
+	return
+}
+
+func (s *fileSink) rotate() (err error) {
+	_ = s.file.Close()
+	s.file = nil
+	_ = os.Remove(fmt.Sprintf(`%s.%d`, s.filename, s.maxFiles))
+	for i := s.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf(`%s.%d`, s.filename, i), fmt.Sprintf(`%s.%d`, s.filename, i+1))
+	}
+	if err = os.Rename(s.filename, s.filename+`.1`); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(entry Entry) (err error) {
+	var line = entry.Format(s.format)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil || (s.size > 0 && s.size+int64(len(line)) > s.maxSize) {
+		if err = s.rotate(); err != nil {
+			return
+		}
+	}
+	var n int
+	n, err = s.file.Write(line)
+	s.size += int64(n)
+	return
+}
+
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	var err = s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,282 @@
+// Package logging writes structured log entries to several sinks: a rotating
+// file, syslog and the operating system's service logger.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level orders entries by severity. The zero value is Info.
+type Level int8
+
+const (
+	Debug Level = iota - 1
+	Info
+	Warning
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return `debug`
+	case Info:
+		return `info`
+	case Warning:
+		return `warning`
+	case Error:
+		return `error`
+	}
+	return strconv.Itoa(int(l))
+}
+
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case `debug`:
+		return Debug, nil
+	case ``, `info`:
+		return Info, nil
+	case `warning`, `warn`:
+		return Warning, nil
+	case `error`:
+		return Error, nil
+	}
+	return Info, fmt.Errorf(`unknown log level: %s`, value)
+}
+
+func (l *Level) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var value string
+	if err = unmarshal(&value); err == nil {
+		*l, err = ParseLevel(value)
+	}
+	return
+}
+
+type Format string
+
+const (
+	FormatText Format = `text`
+	FormatJson Format = `json`
+)
+
+// Fields are the structured part of an entry. Phase names the step of the
+// upgrade pipeline, such as check, download or install.
+type Fields struct {
+	Package  string
+	Service  string
+	Version  string
+	Phase    string
+	Duration time.Duration
+	Error    string
+}
+
+// merge returns f with the non-empty fields of other.
+func (f Fields) merge(other Fields) Fields {
+	if other.Package != `` {
+		f.Package = other.Package
+	}
+	if other.Service != `` {
+		f.Service = other.Service
+	}
+	if other.Version != `` {
+		f.Version = other.Version
+	}
+	if other.Phase != `` {
+		f.Phase = other.Phase
+	}
+	if other.Duration != 0 {
+		f.Duration = other.Duration
+	}
+	if other.Error != `` {
+		f.Error = other.Error
+	}
+	return f
+}
+
+// String renders the fields as key=value pairs, quoting values with spaces.
+func (f Fields) String() string {
+	var pairs []string
+	var add = func(key, value string) {
+		if value == `` {
+			return
+		}
+		if strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, key+`=`+value)
+	}
+	add(`package`, f.Package)
+	add(`service`, f.Service)
+	add(`version`, f.Version)
+	add(`phase`, f.Phase)
+	if f.Duration != 0 {
+		add(`duration`, f.Duration.String())
+	}
+	add(`error`, f.Error)
+	return strings.Join(pairs, ` `)
+}
+
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields
+}
+
+type jsonEntry struct {
+	Time     string  `json:"time"`
+	Level    string  `json:"level"`
+	Message  string  `json:"msg"`
+	Package  string  `json:"package,omitempty"`
+	Service  string  `json:"service,omitempty"`
+	Version  string  `json:"version,omitempty"`
+	Phase    string  `json:"phase,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Text renders the entry without its time, as passed to loggers that add
+// their own timestamp.
+func (e Entry) Text() string {
+	if fields := e.Fields.String(); fields != `` {
+		return e.Message + ` ` + fields
+	}
+	return e.Message
+}
+
+// Format renders the entry as one line. JSON durations are in seconds.
+func (e Entry) Format(format Format) []byte {
+	if format == FormatJson {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(jsonEntry{
+			Time:     e.Time.Format(time.RFC3339Nano),
+			Level:    e.Level.String(),
+			Message:  e.Message,
+			Package:  e.Package,
+			Service:  e.Service,
+			Version:  e.Version,
+			Phase:    e.Phase,
+			Duration: e.Duration.Seconds(),
+			Error:    e.Error,
+		})
+		return buffer.Bytes()
+	}
+	return []byte(fmt.Sprintf("%s %-7s %s\n", e.Time.Format(`2006-01-02T15:04:05.000Z07:00`), strings.ToUpper(e.Level.String()), e.Text()))
+}
+
+// Sink receives every entry at or above the logger's level.
+type Sink interface {
+	Write(entry Entry) error
+}
+
+// Logger fans entries out to its sinks. Besides Log it has the Error,
+// Warning and Info methods of the service logger, so it can be passed
+// wherever one is expected.
+type Logger struct {
+	level  Level
+	sinks  []Sink
+	fields Fields
+	errors func(error)
+}
+
+// New returns a logger writing entries at level and above to sinks. Write
+// errors of sinks are passed to onError, which may be nil.
+func New(level Level, onError func(error), sinks ...Sink) *Logger {
+	return &Logger{level: level, sinks: sinks, errors: onError}
+}
+
+// With returns a logger that adds fields to every entry.
+func (l *Logger) With(fields Fields) *Logger {
+	var logger = *l
+	logger.fields = l.fields.merge(fields)
+	return &logger
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Log(level Level, message string, fields Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+	var entry = Entry{Time: time.Now(), Level: level, Message: message, Fields: l.fields.merge(fields)}
+	for _, sink := range l.sinks {
+		if err := sink.Write(entry); err != nil && l.errors != nil {
+			l.errors(err)
+		}
+	}
+}
+
+func (l *Logger) Error(v ...interface{}) error {
+	l.Log(Error, fmt.Sprint(v...), Fields{})
+	return nil
+}
+
+func (l *Logger) Warning(v ...interface{}) error {
+	l.Log(Warning, fmt.Sprint(v...), Fields{})
+	return nil
+}
+
+func (l *Logger) Info(v ...interface{}) error {
+	l.Log(Info, fmt.Sprint(v...), Fields{})
+	return nil
+}
+
+func (l *Logger) Errorf(format string, a ...interface{}) error {
+	l.Log(Error, fmt.Sprintf(format, a...), Fields{})
+	return nil
+}
+
+func (l *Logger) Warningf(format string, a ...interface{}) error {
+	l.Log(Warning, fmt.Sprintf(format, a...), Fields{})
+	return nil
+}
+
+func (l *Logger) Infof(format string, a ...interface{}) error {
+	l.Log(Info, fmt.Sprintf(format, a...), Fields{})
+	return nil
+}
+
+// Close closes the sinks that hold a file or connection.
+func (l *Logger) Close() {
+	for _, sink := range l.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
+
+// ServiceLogger is the logger of the operating system's service manager,
+// as returned by service.Service.Logger.
+type ServiceLogger interface {
+	Error(v ...interface{}) error
+	Warning(v ...interface{}) error
+	Info(v ...interface{}) error
+}
+
+// serviceSink forwards entries as text to the service logger, which adds its
+// own timestamp. Debug entries are logged as info.
+type serviceSink struct {
+	logger ServiceLogger
+}
+
+func NewServiceSink(logger ServiceLogger) Sink {
+	return serviceSink{logger: logger}
+}
+
+func (s serviceSink) Write(entry Entry) error {
+	switch entry.Level {
+	case Error:
+		return s.logger.Error(entry.Text())
+	case Warning:
+		return s.logger.Warning(entry.Text())
+	}
+	return s.logger.Info(entry.Text())
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogFacility is LOG_DAEMON.
+const syslogFacility = 3
+
+var defaultSyslogAddresses = []string{`/dev/log`, `/var/run/syslog`, `/var/run/log`}
+
+// syslogSink sends entries to the local syslog daemon over its Unix socket,
+// in the format of the C library's syslog(3). It reconnects after a failed
+// write. log/syslog is not used as it does not build on Windows.
+type syslogSink struct {
+	mutex   sync.Mutex
+	address string
+	tag     string
+	format  Format
+	conn    net.Conn
+	stream  bool
+}
+
+// NewSyslogSink connects to the socket at address, or to the first of the
+// usual locations that exists when address is empty.
+func NewSyslogSink(address, tag string, format Format) (Sink, error) {
+	var s = &syslogSink{address: address, tag: tag, format: format}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() (err error) {
+	var addresses = defaultSyslogAddresses
+	if s.address != `` {
+		addresses = []string{s.address}
+	}
+	for _, address := range addresses {
+		if s.conn, err = net.Dial(`unixgram`, address); err == nil {
+			s.stream = false
+			return
+		}
+		if s.conn, err = net.Dial(`unix`, address); err == nil {
+			s.stream = true
+			return
+		}
+	}
+	if err == nil {
+		err = errors.New(`no syslog socket found`)
+	}
+	return
+}
+
+func syslogSeverity(level Level) int {
+	switch level {
+	case Error:
+		return 3
+	case Warning:
+		return 4
+	case Info:
+		return 6
+	}
+	return 7
+}
+
+func (s *syslogSink) message(entry Entry) []byte {
+	var text string
+	if s.format == FormatJson {
+		text = strings.TrimSuffix(string(entry.Format(FormatJson)), "\n")
+	} else {
+		text = entry.Text()
+	}
+	var message = fmt.Sprintf(`<%d>%s %s[%d]: %s`, syslogFacility*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.Stamp), s.tag, os.Getpid(), text)
+	if s.stream {
+		message += "\n"
+	}
+	return []byte(message)
+}
+
+func (s *syslogSink) Write(entry Entry) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		if _, err = s.conn.Write(s.message(entry)); err == nil {
+			return
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	if err = s.connect(); err != nil {
+		return
+	}
+	_, err = s.conn.Write(s.message(entry))
+	return
+}
+
+func (s *syslogSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	var err = s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"sync"
@@ -14,6 +16,9 @@ import (
 	"github.com/kardianos/service"
 	"gopkg.in/yaml.v3"
 
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
+	"github.com/vrherog/daemonupgrader/utils"
 	"github.com/vrherog/daemonupgrader/version"
 )
 
@@ -21,10 +26,11 @@ var (
 	appVersion bool
 	svcFlag    string
 
-	logger service.Logger
+	logger *logging.Logger
 
 	upgradeReadyFile = `upgrade.ready`
 	upgradeOkFile    = `upgrade.ok`
+	stateFile        = `upgrade.state`
 )
 
 type PackageStatus uint8
@@ -35,6 +41,18 @@ const (
 	upgradeOk
 )
 
+func (s PackageStatus) String() string {
+	switch s {
+	case checkServiceStatus:
+		return `checking`
+	case checkUpgrade:
+		return `upgrading`
+	case upgradeOk:
+		return `applying`
+	}
+	return ``
+}
+
 type ServiceConfig struct {
 	Name             string                 `yaml:"name"`
 	DisplayName      string                 `yaml:"displayName,omitempty"`
@@ -43,8 +61,20 @@ type ServiceConfig struct {
 	UserName         string                 `yaml:"username,omitempty"`
 	WorkingDirectory string                 `yaml:"workDirectory,omitempty"`
 	Options          map[string]interface{} `yaml:"options,omitempty"`
+	Jitter           time.Duration          `yaml:"jitter,omitempty"`
+	Concurrency      upgrader.Concurrency   `yaml:"concurrency,omitempty"`
+	ShutdownTimeout  time.Duration          `yaml:"shutdownTimeout,omitempty"`
+	Http             utils.HttpOptions      `yaml:"http,omitempty"`
+	RateLimit        utils.ByteSize         `yaml:"rateLimit,omitempty"`
+	CacheDirectory   string                 `yaml:"cacheDirectory,omitempty"`
+	CacheKeep        int                    `yaml:"cacheKeep,omitempty"`
+	Control          ControlConfig          `yaml:"control,omitempty"`
+	Metrics          MetricsConfig          `yaml:"metrics,omitempty"`
+	Notifications    []upgrader.StageConfig `yaml:"notifications,omitempty"`
+	Log              logging.Config         `yaml:"log,omitempty"`
+	History          HistoryConfig          `yaml:"history,omitempty"`
 	Services         []ServiceInfo          `yaml:"services"`
-	Packages         []UpgradePackageInfo   `yaml:"packages"`
+	Packages         []upgrader.Package     `yaml:"packages"`
 }
 
 func init() {
@@ -54,12 +84,20 @@ func init() {
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+	}
 	flag.Parse()
 
 	if appVersion {
 		fmt.Println(version.BuildVersion)
 		return
 	}
+	if flag.Arg(0) == selfWatchCommand {
+		os.Exit(runSelfWatch(flag.Args()[1:]))
+	}
 
 	var err error
 	var confFile string
@@ -71,6 +109,9 @@ func main() {
 		execName = execName[:len(execName)-len(ext)]
 	}
 	var execDir = filepath.Dir(execFile)
+	if selfExecutable, err = filepath.EvalSymlinks(execFile); err != nil {
+		selfExecutable = execFile
+	}
 	for _, confFile = range []string{
 		`config.yaml`,
 		fmt.Sprintf(`%s.yaml`, execName),
@@ -99,6 +140,7 @@ func main() {
 
 	upgradeReadyFile = filepath.Join(execDir, upgradeReadyFile)
 	upgradeOkFile = filepath.Join(execDir, upgradeOkFile)
+	stateFile = filepath.Join(execDir, stateFile)
 
 	var svcConfig = &service.Config{
 		Name:             conf.Name,
@@ -111,25 +153,83 @@ func main() {
 	if conf.Name == `` {
 		conf.Name = execName
 	}
-	if conf.Services != nil {
-		for _, s := range conf.Services {
-			if s.Interval.Seconds() < 3 {
-				s.Interval = time.Second * 3
-			}
+	for i := range conf.Services {
+		if conf.Services[i].Interval <= 0 {
+			conf.Services[i].Interval = time.Second * 3
+		}
+		if conf.Services[i].RestartWindow <= 0 {
+			conf.Services[i].RestartWindow = time.Minute * 10
 		}
 	}
-	if conf.Packages != nil {
-		for _, p := range conf.Packages {
-			if p.Interval.Seconds() < 30 {
-				p.Interval = time.Minute * 30
-			}
+	for i := range conf.Packages {
+		if conf.Packages[i].Interval <= 0 {
+			conf.Packages[i].Interval = time.Minute * 30
+		}
+		if conf.Packages[i].Jitter == nil {
+			conf.Packages[i].Jitter = &conf.Jitter
+		}
+		if conf.Packages[i].Name == selfPackage {
+			setupSelfPackage(&conf.Packages[i])
 		}
 	}
 
+	if conf.CacheDirectory == `` {
+		conf.CacheDirectory = filepath.Join(execDir, `cache`)
+	}
+	if conf.CacheKeep < 1 {
+		conf.CacheKeep = 2
+	}
+	if conf.Control.Socket == `` {
+		conf.Control.Socket = filepath.Join(execDir, execName+`.sock`)
+	}
+	if !conf.Control.Disabled {
+		controlSocket = conf.Control.Socket
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = time.Second * 30
+	}
+	if conf.History.File == `` {
+		conf.History.File = filepath.Join(execDir, `upgrade.history`)
+	}
+	if conf.Log.File.Path == `` {
+		conf.Log.File.Path = filepath.Join(execDir, execName+`.log`)
+	}
+	if conf.Log.Syslog.Tag == `` {
+		conf.Log.Syslog.Tag = execName
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(&conf, flag.Args()))
+	}
+
+	var machineID string
+	if machineID, err = utils.MachineID(context.Background()); err != nil {
+		log.Printf(`machine id unavailable, using one generated and kept in the state file: %s`, err)
+		machineID = ``
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	var packages = make([]*upgrader.Package, len(conf.Packages))
+	for i := range conf.Packages {
+		packages[i] = &conf.Packages[i]
+	}
 	var prg = &program{
-		services: conf.Services,
-		packages: conf.Packages,
-		tasks:    sync.Map{},
+		shutdownTimeout: conf.ShutdownTimeout,
+		options: upgrader.Options{
+			MachineID:      machineID,
+			Http:           conf.Http,
+			RateLimit:      conf.RateLimit,
+			CacheDirectory: conf.CacheDirectory,
+			CacheKeep:      conf.CacheKeep,
+			Concurrency:    conf.Concurrency,
+		},
+		control:       conf.Control,
+		metricsConfig: conf.Metrics,
+		notifications: conf.Notifications,
+		historyConfig: conf.History,
+		services:      conf.Services,
+		packages:      packages,
+		tasks:         sync.Map{},
 	}
 	var srv service.Service
 	srv, err = service.New(prg, svcConfig)
@@ -138,9 +238,14 @@ func main() {
 	}
 
 	var errs = make(chan error, 5)
-	if logger, err = srv.Logger(errs); err != nil {
+	var serviceLogger service.Logger
+	if serviceLogger, err = srv.Logger(errs); err != nil {
+		log.Fatal(err)
+	}
+	if logger, err = logging.Open(conf.Log, serviceLogger, func(err error) { log.Print(err) }); err != nil {
 		log.Fatal(err)
 	}
+	defer logger.Close()
 
 	go func() {
 		for {
@@ -160,6 +265,6 @@ func main() {
 	}
 
 	if err = srv.Run(); err != nil {
-		_ = logger.Error(err)
+		logger.Log(logging.Error, `service stopped`, logging.Fields{Error: err.Error()})
 	}
 }
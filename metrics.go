@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	defaultMetricsPath = `/metrics`
+
+	probeRunning = `running`
+	probeStopped = `stopped`
+	probeError   = `error`
+)
+
+type MetricsConfig struct {
+	Listen string `yaml:"listen,omitempty"`
+	Path   string `yaml:"path,omitempty"`
+}
+
+// metrics collects counters for the Prometheus endpoint. Pipeline figures
+// come in as events, service probes are recorded by checkServiceStatus.
+type metrics struct {
+	mutex           sync.Mutex
+	serviceUp       map[string]bool
+	serviceProbes   map[[2]string]uint64
+	serviceRestarts map[string]uint64
+	lastSuccess     map[string]time.Time
+	checkErrors     map[string]uint64
+	downloadErrors  map[string]uint64
+	downloadBytes   map[string]int64
+	downloadSeconds map[string]float64
+	downloads       map[string]uint64
+	upgrades        map[[2]string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		serviceUp:       make(map[string]bool),
+		serviceProbes:   make(map[[2]string]uint64),
+		serviceRestarts: make(map[string]uint64),
+		lastSuccess:     make(map[string]time.Time),
+		checkErrors:     make(map[string]uint64),
+		downloadErrors:  make(map[string]uint64),
+		downloadBytes:   make(map[string]int64),
+		downloadSeconds: make(map[string]float64),
+		downloads:       make(map[string]uint64),
+		upgrades:        make(map[[2]string]uint64),
+	}
+}
+
+func (m *metrics) Notify(event upgrader.Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch event.Type {
+	case upgrader.EventCheckSucceeded:
+		m.lastSuccess[event.Package] = event.Time
+	case upgrader.EventCheckFailed:
+		m.checkErrors[event.Package]++
+	case upgrader.EventDownloadSucceeded:
+		m.downloads[event.Package]++
+		m.downloadBytes[event.Package] += event.Bytes
+		m.downloadSeconds[event.Package] += event.Duration.Seconds()
+	case upgrader.EventDownloadFailed:
+		m.downloadErrors[event.Package]++
+	case upgrader.EventUpgradeSucceeded:
+		m.upgrades[[2]string{event.Package, `success`}]++
+	case upgrader.EventUpgradeFailed:
+		m.upgrades[[2]string{event.Package, `failure`}]++
+	case upgrader.EventServiceRestarted:
+		m.serviceRestarts[event.Service]++
+	}
+}
+
+func (m *metrics) probe(name, result string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.serviceUp[name] = result == probeRunning
+	m.serviceProbes[[2]string{name, result}]++
+}
+
+// snapshot copies the counters, so that they can be written out without
+// holding up Notify while the client reads them.
+func (m *metrics) snapshot() *metrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var copied = newMetrics()
+	for key, value := range m.serviceUp {
+		copied.serviceUp[key] = value
+	}
+	for key, value := range m.serviceProbes {
+		copied.serviceProbes[key] = value
+	}
+	for key, value := range m.serviceRestarts {
+		copied.serviceRestarts[key] = value
+	}
+	for key, value := range m.lastSuccess {
+		copied.lastSuccess[key] = value
+	}
+	for key, value := range m.checkErrors {
+		copied.checkErrors[key] = value
+	}
+	for key, value := range m.downloadErrors {
+		copied.downloadErrors[key] = value
+	}
+	for key, value := range m.downloadBytes {
+		copied.downloadBytes[key] = value
+	}
+	for key, value := range m.downloadSeconds {
+		copied.downloadSeconds[key] = value
+	}
+	for key, value := range m.downloads {
+		copied.downloads[key] = value
+	}
+	for key, value := range m.upgrades {
+		copied.upgrades[key] = value
+	}
+	return copied
+}
+
+// metricWriter writes the Prometheus text exposition format.
+type metricWriter struct {
+	out io.Writer
+}
+
+func (w metricWriter) header(name, kind, help string) {
+	fmt.Fprintf(w.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels are given as name, value pairs.
+func (w metricWriter) sample(name string, value float64, labels ...string) {
+	var pairs = make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		fmt.Fprintf(w.out, "%s{%s} %v\n", name, strings.Join(pairs, `,`), value)
+	} else {
+		fmt.Fprintf(w.out, "%s %v\n", name, value)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	var keys = make([][2]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func (p *program) writeMetrics(out io.Writer) {
+	var w = metricWriter{out: out}
+	var m = p.metrics.snapshot()
+
+	w.header(`daemonupgrader_build_info`, `gauge`, `Version of the running daemon.`)
+	w.sample(`daemonupgrader_build_info`, 1, `version`, version.BuildVersion)
+	w.header(`daemonupgrader_paused`, `gauge`, `Whether automatic upgrades are paused.`)
+	w.sample(`daemonupgrader_paused`, boolValue(p.upgrader.State().IsPaused()))
+
+	w.header(`daemonupgrader_service_up`, `gauge`, `Whether the service was running at the last probe.`)
+	for _, s := range p.services {
+		if up, ok := m.serviceUp[s.Name]; ok {
+			w.sample(`daemonupgrader_service_up`, boolValue(up), `service`, s.Name)
+		}
+	}
+	w.header(`daemonupgrader_service_probes_total`, `counter`, `Service probes by result.`)
+	for _, key := range sortedPairs(m.serviceProbes) {
+		w.sample(`daemonupgrader_service_probes_total`, float64(m.serviceProbes[key]), `service`, key[0], `result`, key[1])
+	}
+	w.header(`daemonupgrader_service_restarts_total`, `counter`, `Services started again after being found stopped.`)
+	for _, name := range sortedKeys(m.serviceRestarts) {
+		w.sample(`daemonupgrader_service_restarts_total`, float64(m.serviceRestarts[name]), `service`, name)
+	}
+
+	w.header(`daemonupgrader_package_info`, `gauge`, `Installed version of the package.`)
+	for _, s := range p.packages {
+		var state, _ = p.upgrader.State().Get(s.Name)
+		w.sample(`daemonupgrader_package_info`, 1, `package`, s.Name, `version`, state.LocalVersion)
+	}
+	w.header(`daemonupgrader_package_last_success_timestamp_seconds`, `gauge`, `Time of the last successful check.`)
+	for _, s := range p.packages {
+		if t, ok := m.lastSuccess[s.Name]; ok {
+			w.sample(`daemonupgrader_package_last_success_timestamp_seconds`, float64(t.Unix()), `package`, s.Name)
+		}
+	}
+	w.header(`daemonupgrader_package_check_errors_total`, `counter`, `Failed version checks.`)
+	for _, name := range sortedKeys(m.checkErrors) {
+		w.sample(`daemonupgrader_package_check_errors_total`, float64(m.checkErrors[name]), `package`, name)
+	}
+	w.header(`daemonupgrader_package_download_errors_total`, `counter`, `Failed downloads.`)
+	for _, name := range sortedKeys(m.downloadErrors) {
+		w.sample(`daemonupgrader_package_download_errors_total`, float64(m.downloadErrors[name]), `package`, name)
+	}
+	w.header(`daemonupgrader_package_downloads_total`, `counter`, `Completed downloads.`)
+	for _, name := range sortedKeys(m.downloads) {
+		w.sample(`daemonupgrader_package_downloads_total`, float64(m.downloads[name]), `package`, name)
+	}
+	w.header(`daemonupgrader_package_download_bytes_total`, `counter`, `Bytes of completed downloads.`)
+	for _, name := range sortedKeys(m.downloads) {
+		w.sample(`daemonupgrader_package_download_bytes_total`, float64(m.downloadBytes[name]), `package`, name)
+	}
+	w.header(`daemonupgrader_package_download_seconds_total`, `counter`, `Time spent on completed downloads.`)
+	for _, name := range sortedKeys(m.downloads) {
+		w.sample(`daemonupgrader_package_download_seconds_total`, m.downloadSeconds[name], `package`, name)
+	}
+	w.header(`daemonupgrader_package_upgrades_total`, `counter`, `Upgrades by result.`)
+	for _, key := range sortedPairs(m.upgrades) {
+		w.sample(`daemonupgrader_package_upgrades_total`, float64(m.upgrades[key]), `package`, key[0], `result`, key[1])
+	}
+
+	var tasks = make(map[PackageStatus]int)
+	p.tasks.Range(func(_, status interface{}) bool {
+		tasks[status.(PackageStatus)]++
+		return true
+	})
+	w.header(`daemonupgrader_tasks_active`, `gauge`, `Scheduled tasks currently running.`)
+	for _, status := range []PackageStatus{checkServiceStatus, checkUpgrade, upgradeOk} {
+		w.sample(`daemonupgrader_tasks_active`, float64(tasks[status]), `task`, status.String())
+	}
+	w.header(`daemonupgrader_workers_active`, `gauge`, `Workers holding a slot of each pool.`)
+	w.sample(`daemonupgrader_workers_active`, float64(p.upgrader.Checks.Active()), `pool`, `checks`)
+	w.sample(`daemonupgrader_workers_active`, float64(p.upgrader.Downloads.Active()), `pool`, `downloads`)
+	w.sample(`daemonupgrader_workers_active`, float64(p.upgrader.Installs.Active()), `pool`, `installs`)
+}
+
+func (p *program) startMetrics() (err error) {
+	if p.metricsConfig.Listen == `` {
+		return
+	}
+	var path = p.metricsConfig.Path
+	if path == `` {
+		path = defaultMetricsPath
+	}
+	var listener net.Listener
+	if listener, err = net.Listen(`tcp`, p.metricsConfig.Listen); err != nil {
+		return
+	}
+	var mux = http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+		p.writeMetrics(w)
+	})
+	p.metricsServer = &http.Server{Handler: mux}
+	go func() {
+		if err := p.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Log(logging.Error, `metrics server stopped`, logging.Fields{Error: err.Error()})
+		}
+	}()
+	return
+}
+
+func (p *program) stopMetrics() {
+	if p.metricsServer == nil {
+		return
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = p.metricsServer.Shutdown(ctx)
+}
@@ -1,89 +1,142 @@
 package main
 
 import (
-	"strings"
+	"context"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/kardianos/service"
 
-	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
 )
 
 type ServiceInfo struct {
-	Name     string        `yaml:"name"`
-	Interval time.Duration `yaml:"interval,omitempty"`
-}
-
-type UpgradePackageInfo struct {
-	Name               string        `yaml:"name"`
-	Interval           time.Duration `yaml:"interval,omitempty"`
-	UriCheckVersion    string        `yaml:"uriCheckVersion"`
-	UriDownloadPackage string        `yaml:"uriDownloadPackage"`
-	WorkDirectory      string        `yaml:"workDirectory"`
-	CommandGetVersion  string        `yaml:"commandGetVersion"`
-	NeedShutdown       bool          `yaml:"needShutdown,omitempty"`
-}
-
-func (p *UpgradePackageInfo) Validate() bool {
-	return p.UriCheckVersion != `` && p.UriDownloadPackage != `` && p.WorkDirectory != `` && p.CommandGetVersion != ``
+	Name          string        `yaml:"name"`
+	Interval      time.Duration `yaml:"interval,omitempty"`
+	MaxRestarts   int           `yaml:"maxRestarts,omitempty"`
+	RestartWindow time.Duration `yaml:"restartWindow,omitempty"`
 }
 
 type program struct {
-	tick     uint64
-	exit     chan struct{}
-	tasks    sync.Map
-	services []ServiceInfo
-	packages []UpgradePackageInfo
+	started         time.Time
+	ctx             context.Context
+	cancel          context.CancelFunc
+	installCtx      context.Context
+	cancelInstalls  context.CancelFunc
+	shutdownTimeout time.Duration
+	wg              sync.WaitGroup
+	options         upgrader.Options
+	upgrader        *upgrader.Upgrader
+	history         *history
+	stream          *eventStream
+	historyConfig   HistoryConfig
+	control         ControlConfig
+	controlServer   *http.Server
+	metrics         *metrics
+	metricsConfig   MetricsConfig
+	metricsServer   *http.Server
+	tasks           sync.Map
+	restarts        sync.Map
+	exiting         sync.Map
+	notifications   []upgrader.StageConfig
+	services        []ServiceInfo
+	packages        []*upgrader.Package
 }
 
 func (p *program) Start(s service.Service) error {
 	if service.Interactive() {
-		_ = logger.Info(`Running in terminal.`)
+		logger.Log(logging.Info, `running in terminal`, logging.Fields{})
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.installCtx, p.cancelInstalls = context.WithCancel(context.Background())
+	p.started = time.Now()
+	var options = p.options
+	options.Logger = logger
+	options.State = upgrader.LoadState(stateFile)
+	options.UpgradeReadyFile = upgradeReadyFile
+	options.InstallContext = p.installCtx
+	p.upgrader = upgrader.New(options)
+	if h, err := openHistory(p.historyConfig); err != nil {
+		logger.Log(logging.Error, `history `+p.historyConfig.File+` disabled`, logging.Fields{Error: err.Error()})
+	} else {
+		p.history = h
+		p.upgrader.AddNotifier(h)
 	}
-	p.exit = make(chan struct{})
+	p.metrics = newMetrics()
+	p.upgrader.AddNotifier(p.metrics)
+	p.stream = newEventStream()
+	p.upgrader.AddNotifier(p.stream)
+	for _, config := range p.notifications {
+		if n, err := p.upgrader.NewNotifier(config); err != nil {
+			logger.Log(logging.Error, `notification `+config.Type+` disabled`, logging.Fields{Error: err.Error()})
+		} else {
+			p.upgrader.AddNotifier(n)
+		}
+	}
+	p.checkProbation()
 
-	go p.run()
+	_ = p.schedule(time.Second, p.checkUpgradeOk)
+	for _, s := range p.services {
+		var s = s
+		if err := p.schedule(s.Interval, func() {
+			p.checkServiceStatus(s)
+		}); err != nil {
+			logger.Log(logging.Error, `service disabled`, logging.Fields{Service: s.Name, Error: err.Error()})
+		}
+	}
+	var packages = make([]*upgrader.Package, 0, len(p.packages))
+	for _, s := range p.packages {
+		var packageInfo = s
+		if packageInfo.Name == selfPackage {
+			packageInfo.LocalVersion = p.selfVersion
+		}
+		if err := p.upgrader.Prepare(packageInfo); err != nil {
+			logger.Log(logging.Error, `package disabled`, logging.Fields{Package: packageInfo.Name, Error: err.Error()})
+			continue
+		}
+		if err := p.schedule(packageInfo.Interval, func() {
+			p.checkUpgrade(packageInfo)
+		}); err != nil {
+			logger.Log(logging.Error, `package disabled`, logging.Fields{Package: packageInfo.Name, Error: err.Error()})
+			continue
+		}
+		packages = append(packages, packageInfo)
+	}
+	p.packages = packages
+	if err := p.startControl(); err != nil {
+		logger.Log(logging.Error, `control socket `+p.control.Socket+` disabled`, logging.Fields{Error: err.Error()})
+	}
+	if err := p.startMetrics(); err != nil {
+		logger.Log(logging.Error, `metrics listener `+p.metricsConfig.Listen+` disabled`, logging.Fields{Error: err.Error()})
+	}
 	return nil
 }
 
-func (p *program) run() error {
-	var ticker = time.NewTicker(time.Second)
-	for {
+func (p *program) Stop(s service.Service) error {
+	p.cancel()
+	p.stopControl()
+	p.stopMetrics()
+	var done = make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(p.shutdownTimeout):
+		logger.Log(logging.Warning, `installs still running, rolling back`, logging.Fields{Phase: `install`, Duration: p.shutdownTimeout})
+		p.cancelInstalls()
 		select {
-		case <-ticker.C:
-			if content, ok := utils.ReadTextFile(upgradeOkFile); ok {
-				for _, name := range strings.Fields(content) {
-					if _, ok := p.tasks.Load(name); !ok {
-						go p.upgradePackage(name)
-					}
-				}
-			}
-			for _, s := range p.services {
-				if p.tick%uint64(s.Interval.Seconds()) == 0 {
-					if _, ok := p.tasks.Load(s.Name); !ok {
-						go p.checkServiceStatus(s.Name)
-					}
-				}
-			}
-			for _, s := range p.packages {
-				if s.Validate() {
-					if p.tick%uint64(s.Interval.Seconds()) == 0 {
-						if v, ok := p.tasks.Load(s.Name); !ok || v == checkServiceStatus {
-							go p.checkUpgrade(s)
-						}
-					}
-				}
-			}
-			p.tick++
-		case <-p.exit:
-			ticker.Stop()
-			return nil
+		case <-done:
+		case <-time.After(p.shutdownTimeout):
+			logger.Log(logging.Error, `installs did not stop, exiting anyway`, logging.Fields{Phase: `install`, Duration: p.shutdownTimeout})
 		}
 	}
-}
-
-func (p *program) Stop(s service.Service) error {
-	close(p.exit)
-	return nil
+	p.cancelInstalls()
+	if err := p.upgrader.CloseNotifiers(); err != nil {
+		logger.Log(logging.Warning, `close notifications failed`, logging.Fields{Phase: `notify`, Error: err.Error()})
+	}
+	return p.upgrader.State().Save()
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func serviceTaskKey(name string) string {
+	return `service:` + name
+}
+
+func packageTaskKey(name string) string {
+	return `package:` + name
+}
+
+func (p *program) tryStartTask(key string, status PackageStatus) bool {
+	_, loaded := p.tasks.LoadOrStore(key, status)
+	return !loaded
+}
+
+func (p *program) finishTask(key string) {
+	p.tasks.Delete(key)
+}
+
+// nextRun is the run after previous on the grid of interval, skipping the
+// runs missed while a task was slow.
+func nextRun(previous, now time.Time, interval time.Duration) time.Time {
+	var next = previous.Add(interval)
+	if next.Before(now) {
+		next = next.Add(now.Sub(next).Truncate(interval) + interval)
+	}
+	return next
+}
+
+// schedule runs task at p.started and every interval after it until the
+// program stops. Runs that would overlap a slow task are skipped.
+func (p *program) schedule(interval time.Duration, task func()) error {
+	if interval <= 0 {
+		return fmt.Errorf(`invalid interval %s`, interval)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var next = p.started
+		var timer = time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				task()
+				next = nextRun(next, time.Now(), interval)
+				timer.Reset(time.Until(next))
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRun(t *testing.T) {
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name     string
+		previous time.Time
+		now      time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{`task finished in time`, start, start.Add(time.Second), time.Minute, start.Add(time.Minute)},
+		{`task finished at the next run`, start, start.Add(time.Minute), time.Minute, start.Add(time.Minute)},
+		{`one run missed`, start, start.Add(90 * time.Second), time.Minute, start.Add(2 * time.Minute)},
+		{`several runs missed`, start, start.Add(5*time.Minute + time.Second), time.Minute, start.Add(6 * time.Minute)},
+		{`missed exactly on the grid`, start, start.Add(3 * time.Minute), time.Minute, start.Add(4 * time.Minute)},
+		{`sub-second interval`, start, start.Add(1250 * time.Millisecond), 500 * time.Millisecond, start.Add(1500 * time.Millisecond)},
+		{`clock behind previous run`, start, start.Add(-time.Hour), time.Minute, start.Add(time.Minute)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got = nextRun(test.previous, test.now, test.interval)
+			if !got.Equal(test.want) {
+				t.Errorf(`got %s, want %s`, got.Sub(start), test.want.Sub(start))
+			}
+			if got.Before(test.now) || got.Sub(start)%test.interval != 0 {
+				t.Errorf(`%s is not a run on the grid after now`, got.Sub(start))
+			}
+		})
+	}
+}
+
+func TestScheduleRejectsInterval(t *testing.T) {
+	var p = &program{}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := p.schedule(interval, func() {}); err == nil {
+			t.Errorf(`schedule accepted interval %s`, interval)
+		}
+	}
+}
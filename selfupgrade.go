@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/upgrader"
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	selfPackage      = `self`
+	installerSelf    = `self`
+	selfWatchCommand = `self-watch`
+
+	defaultSelfHealthTimeout = 2 * time.Minute
+	selfHealthInterval       = 5 * time.Second
+	selfVersionTimeout       = 30 * time.Second
+	selfWatchMargin          = 2 * selfHealthInterval
+)
+
+var errInteractive = errors.New(`not running as a service`)
+
+// selfExecutable is the file of the running daemon, with symbolic links
+// resolved.
+var selfExecutable string
+
+// controlSocket is the control socket the self-watch helper probes, empty
+// when the control interface is disabled.
+var controlSocket string
+
+// SelfUpgradeConfig holds the options of the self installer, written in the
+// installer mapping of the self package.
+type SelfUpgradeConfig struct {
+	// Binary is the name of the executable in the package, by default the
+	// name of the running one.
+	Binary string `yaml:"binary,omitempty"`
+	// HealthTimeout is how long a new build has after it starts to answer on
+	// the control socket before the previous one is put back.
+	HealthTimeout time.Duration `yaml:"healthTimeout,omitempty"`
+}
+
+func selfUpgradeConfig(pkg *upgrader.Package) (config SelfUpgradeConfig, err error) {
+	if pkg != nil {
+		if err = pkg.Installer.Decode(&config); err != nil {
+			return
+		}
+	}
+	if config.Binary == `` {
+		config.Binary = filepath.Base(selfExecutable)
+	}
+	if config.HealthTimeout <= 0 {
+		config.HealthTimeout = defaultSelfHealthTimeout
+	}
+	return
+}
+
+func init() {
+	upgrader.RegisterInstaller(installerSelf, func(u *upgrader.Upgrader, pkg *upgrader.Package) (upgrader.Installer, error) {
+		if pkg.Name != selfPackage {
+			return nil, fmt.Errorf(`installer %s is only for the %s package`, installerSelf, selfPackage)
+		}
+		var i = &selfInstaller{u: u}
+		var err error
+		i.config, err = selfUpgradeConfig(pkg)
+		return i, err
+	})
+}
+
+// setupSelfPackage fills in the self package entry, which upgrades the daemon
+// itself: it lives next to the running executable, is installed by the self
+// installer and its installed version is version.BuildVersion. The program
+// replaces LocalVersion once the state is loaded.
+func setupSelfPackage(pkg *upgrader.Package) {
+	if pkg.WorkDirectory == `` {
+		pkg.WorkDirectory = filepath.Dir(selfExecutable)
+	}
+	if pkg.Installer.Type == `` {
+		pkg.Installer.Type = installerSelf
+	}
+	pkg.LocalVersion = func(ctx context.Context) (string, error) {
+		return version.BuildVersion, nil
+	}
+}
+
+// selfVersion is the installed version of the self package: the running
+// build, or the build swapped in that the daemon has not restarted into yet.
+func (p *program) selfVersion(ctx context.Context) (string, error) {
+	if state, ok := p.upgrader.State().Get(selfPackage); ok && state.Probation != nil && state.Probation.Previous == version.BuildVersion {
+		return state.Probation.Version, nil
+	}
+	return version.BuildVersion, nil
+}
+
+// selfInstaller replaces the executable of the daemon with the one in the
+// package and has the service manager restart it. The new build is on
+// probation until it turns healthy, see program.checkProbation, and is
+// watched from outside by the previous build, see runSelfWatch.
+type selfInstaller struct {
+	u      *upgrader.Upgrader
+	config SelfUpgradeConfig
+}
+
+func (i *selfInstaller) Install(ctx context.Context, release upgrader.Release, dir string) (staged bool, err error) {
+	if !i.u.Installs.Acquire(ctx) {
+		err = upgrader.ErrStopping
+		return
+	}
+	defer i.u.Installs.Release()
+	var binary string
+	if binary, err = findBinary(dir, i.config.Binary); err != nil {
+		return
+	}
+	if err = os.Chmod(binary, 0755); err != nil {
+		return
+	}
+	var reported string
+	if reported, err = binaryVersion(ctx, binary); err != nil {
+		return
+	}
+	if comp, ok := version.CompareVersion(reported, release.Version); !ok || comp != 0 {
+		return false, fmt.Errorf(`%s reports version %s instead of %s`, i.config.Binary, reported, release.Version)
+	}
+	var backup = selfExecutable + `.previous`
+	if err = replaceExecutable(selfExecutable, backup); err != nil {
+		return
+	}
+	var state = i.u.State()
+	state.Update(selfPackage, func(state *upgrader.PackageState) {
+		state.Probation = &upgrader.Probation{Version: release.Version, Previous: version.BuildVersion, Backup: backup}
+	})
+	if err = state.Save(); err == nil {
+		err = replaceExecutable(binary, selfExecutable)
+	}
+	if err != nil {
+		state.Update(selfPackage, func(state *upgrader.PackageState) {
+			state.Probation = nil
+		})
+		_ = state.Save()
+		return
+	}
+	_ = os.RemoveAll(dir)
+	logger.Log(logging.Info, `executable replaced, restarting`, logging.Fields{Package: selfPackage, Version: release.Version, Phase: `install`})
+	if service.Interactive() {
+		logger.Log(logging.Warning, `restart the daemon to run the new version`, logging.Fields{Package: selfPackage, Version: release.Version, Error: errInteractive.Error()})
+		return true, nil
+	}
+	if err := startSelfWatch(backup, release.Version, i.config.HealthTimeout); err != nil {
+		logger.Log(logging.Warning, `start self-watch failed, the new version checks itself only`, logging.Fields{Package: selfPackage, Version: release.Version, Error: err.Error()})
+	}
+	if err := restartService(); err != nil {
+		logger.Log(logging.Warning, `restart the daemon to run the new version`, logging.Fields{Package: selfPackage, Version: release.Version, Error: err.Error()})
+	}
+	return true, nil
+}
+
+// findBinary looks for the executable called name in dir and below.
+func findBinary(dir, name string) (binary string, err error) {
+	if info, e := os.Stat(filepath.Join(dir, name)); e == nil && info.Mode().IsRegular() {
+		return filepath.Join(dir, name), nil
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && binary == `` && info.Mode().IsRegular() && info.Name() == name {
+			binary = path
+		}
+		return err
+	})
+	if err == nil && binary == `` {
+		err = fmt.Errorf(`%s not found in the package`, name)
+	}
+	return
+}
+
+// binaryVersion runs binary -v, which also proves that it runs on this host.
+func binaryVersion(ctx context.Context, binary string) (string, error) {
+	var ctx2, cancel = context.WithTimeout(ctx, selfVersionTimeout)
+	defer cancel()
+	var output, err = utils.ExecCommand(ctx2, binary, `-v`)
+	if err != nil {
+		return ``, fmt.Errorf(`run %s: %s`, filepath.Base(binary), err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// replaceExecutable atomically puts a copy of source in place of target,
+// keeping the permissions of target. Windows does not let the running
+// executable be replaced, only renamed, so there it is moved aside first.
+func replaceExecutable(source, target string) (err error) {
+	var content []byte
+	if content, err = ioutil.ReadFile(source); err != nil {
+		return
+	}
+	var perm os.FileMode = 0755
+	if info, e := os.Stat(target); e == nil {
+		perm = info.Mode().Perm()
+	}
+	if runtime.GOOS == `windows` && target == selfExecutable {
+		var aside = target + `.old`
+		_ = os.Remove(aside)
+		if err = os.Rename(target, aside); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		if err = utils.WriteFileAtomic(target, content, perm); err != nil {
+			_ = os.Rename(aside, target)
+		}
+		return
+	}
+	return utils.WriteFileAtomic(target, content, perm)
+}
+
+// restartService has the service manager restart the daemon. The restart
+// stops this process, so it is requested by a separate one running
+// "<executable> -service restart".
+func restartService() error {
+	if service.Interactive() {
+		return errInteractive
+	}
+	var cmd = exec.Command(selfExecutable, `-service`, `restart`)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	return nil
+}
+
+// startSelfWatch runs the previous build, kept at backup, as a detached
+// "self-watch" helper that puts it back if the new build does not turn
+// healthy. Under systemd the helper is moved out of the service's control
+// group, which is killed on restart.
+func startSelfWatch(backup, newVersion string, timeout time.Duration) error {
+	var args = []string{selfWatchCommand, `-target`, selfExecutable, `-backup`, backup, `-state`, stateFile,
+		`-version`, newVersion, `-timeout`, timeout.String()}
+	if controlSocket != `` {
+		args = append(args, `-socket`, controlSocket)
+	}
+	var cmd = exec.Command(backup, args...)
+	if service.ChosenSystem().String() == `linux-systemd` {
+		if systemdRun, err := exec.LookPath(`systemd-run`); err == nil {
+			cmd = exec.Command(systemdRun, append([]string{`--scope`, `--quiet`, backup}, args...)...)
+		}
+	}
+	utils.Detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// runSelfWatch is the self-watch helper. It waits until the build swapped in
+// reports its version on the control socket, or its probation has ended in
+// the state. It gives up after the health timeout, or after the deadline the
+// new build recorded on its first start, plus a margin that lets a running
+// build decide first. Then it restores the backup and restarts the service;
+// the restored build records the rollback. It does not depend on the new
+// build at all, so a build that crashes before it starts is caught as well.
+func runSelfWatch(args []string) int {
+	var flags = flag.NewFlagSet(selfWatchCommand, flag.ContinueOnError)
+	var target = flags.String(`target`, ``, `executable of the daemon`)
+	var backup = flags.String(`backup`, ``, `copy of the previous executable`)
+	var state = flags.String(`state`, ``, `state file`)
+	var expected = flags.String(`version`, ``, `version on probation`)
+	var socket = flags.String(`socket`, ``, `control socket`)
+	var timeout = flags.Duration(`timeout`, defaultSelfHealthTimeout, `health timeout`)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *target == `` || *backup == `` || *state == `` || *expected == `` {
+		log.Print(`self-watch needs -target, -backup, -state and -version`)
+		return 2
+	}
+	selfExecutable = *target
+	var probation = func() *upgrader.Probation {
+		if state, ok := upgrader.LoadState(*state).Get(selfPackage); ok && state.Probation != nil && state.Probation.Version == *expected {
+			return state.Probation
+		}
+		return nil
+	}
+	for deadline := time.Now().Add(*timeout + selfWatchMargin); time.Now().Before(deadline); {
+		time.Sleep(selfHealthInterval)
+		var current = probation()
+		if current == nil {
+			return 0
+		}
+		if *socket != `` && probeVersion(*socket, *expected) == nil {
+			return 0
+		}
+		if later := current.Deadline.Add(selfWatchMargin); later.After(deadline) {
+			deadline = later
+		}
+	}
+	if probation() == nil {
+		return 0
+	}
+	log.Printf(`version %s not healthy, restoring %s`, *expected, *backup)
+	if err := replaceExecutable(*backup, *target); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if output, err := exec.Command(*target, `-service`, `restart`).CombinedOutput(); err != nil {
+		log.Printf(`restart: %s %s`, err, output)
+		return 1
+	}
+	return 0
+}
+
+// checkProbation is called on start. A build on probation gets until its
+// deadline, counted from its first start, to answer on the control socket,
+// and puts the previous build back otherwise. The previous build, once
+// restarted, records the rollback.
+func (p *program) checkProbation() {
+	var state, ok = p.upgrader.State().Get(selfPackage)
+	if !ok || state.Probation == nil {
+		return
+	}
+	var probation = *state.Probation
+	switch version.BuildVersion {
+	case probation.Version:
+		if probation.Deadline.IsZero() {
+			var config, _ = selfUpgradeConfig(p.findPackage(selfPackage))
+			probation.Deadline = time.Now().Add(config.HealthTimeout)
+			p.upgrader.State().Update(selfPackage, func(state *upgrader.PackageState) {
+				state.Probation.Deadline = probation.Deadline
+			})
+			p.saveState()
+		} else if time.Now().After(probation.Deadline) {
+			p.revertSelf(probation, errors.New(`restarted without turning healthy`))
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.watchProbation(probation)
+		}()
+	case probation.Previous:
+		p.upgrader.State().Update(selfPackage, func(state *upgrader.PackageState) {
+			state.Probation = nil
+			state.LocalVersion = version.BuildVersion
+			state.SkipVersion = probation.Version
+		})
+		p.saveState()
+		logger.Log(logging.Error, `version `+probation.Version+` was not healthy, rolled back`, logging.Fields{Package: selfPackage, Version: version.BuildVersion, Phase: `rollback`})
+		p.upgrader.Notify(upgrader.Event{Type: upgrader.EventRolledBack, Package: selfPackage, Version: version.BuildVersion,
+			Error: `version ` + probation.Version + ` was not healthy`})
+	default:
+		p.upgrader.State().Update(selfPackage, func(state *upgrader.PackageState) {
+			state.Probation = nil
+		})
+		p.saveState()
+	}
+}
+
+// watchProbation waits for the control socket to report this build, then
+// ends the probation. At the deadline the previous build is put back.
+func (p *program) watchProbation(probation upgrader.Probation) {
+	var ticker = time.NewTicker(selfHealthInterval)
+	defer ticker.Stop()
+	var deadline = time.NewTimer(time.Until(probation.Deadline))
+	defer deadline.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.healthy(); err != nil {
+				logger.Log(logging.Debug, `not healthy yet`, logging.Fields{Package: selfPackage, Version: probation.Version, Error: err.Error()})
+				continue
+			}
+			p.upgrader.State().Update(selfPackage, func(state *upgrader.PackageState) {
+				state.Probation = nil
+				state.LocalVersion = version.BuildVersion
+				state.LastUpgrade = time.Now()
+				state.SkipVersion = ``
+			})
+			p.saveState()
+			logger.Log(logging.Info, `upgrade completed`, logging.Fields{Package: selfPackage, Version: version.BuildVersion, Phase: `install`})
+			p.upgrader.Notify(upgrader.Event{Type: upgrader.EventUpgradeSucceeded, Package: selfPackage, Version: version.BuildVersion})
+			return
+		case <-deadline.C:
+			p.revertSelf(probation, fmt.Errorf(`not healthy by %s`, probation.Deadline.Format(time.RFC3339)))
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// healthy asks the control socket for the status, which has to come from this
+// build. Without a control socket running is healthy enough.
+func (p *program) healthy() error {
+	if p.control.Disabled {
+		return nil
+	}
+	return probeVersion(p.control.Socket, version.BuildVersion)
+}
+
+// probeVersion asks the control socket for the status, which has to report
+// the expected version.
+func probeVersion(socket, expected string) error {
+	var client = newControlClient(socket)
+	client.client.Timeout = selfHealthInterval
+	var report statusReport
+	if err := client.call(`GET`, `/status`, &report); err != nil {
+		return err
+	}
+	if report.Version != expected {
+		return fmt.Errorf(`control socket reports version %s`, report.Version)
+	}
+	return nil
+}
+
+// revertSelf puts the previous build back and has it started.
+func (p *program) revertSelf(probation upgrader.Probation, cause error) {
+	logger.Log(logging.Error, `upgrade failed, restoring `+probation.Previous, logging.Fields{Package: selfPackage, Version: probation.Version, Phase: `rollback`, Error: cause.Error()})
+	p.upgrader.Notify(upgrader.Event{Type: upgrader.EventUpgradeFailed, Package: selfPackage, Version: probation.Version, Error: cause.Error()})
+	if err := replaceExecutable(probation.Backup, selfExecutable); err != nil {
+		logger.Log(logging.Error, `restore previous executable failed`, logging.Fields{Package: selfPackage, Version: probation.Previous, Phase: `rollback`, Error: err.Error()})
+		return
+	}
+	if err := restartService(); err != nil {
+		logger.Log(logging.Warning, `restart the daemon to run the previous version`, logging.Fields{Package: selfPackage, Version: probation.Previous, Error: err.Error()})
+	}
+}
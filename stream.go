@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/upgrader"
+)
+
+const (
+	streamQueue     = 16
+	streamKeepAlive = 30 * time.Second
+)
+
+// eventStream passes events on to the clients following /events/stream. A
+// client that does not keep up loses events rather than holding the
+// pipeline up.
+type eventStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan upgrader.Event]historyQuery
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: make(map[chan upgrader.Event]historyQuery)}
+}
+
+func (s *eventStream) Notify(event upgrader.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch, q := range s.subscribers {
+		if q.match(event) {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+func (s *eventStream) subscribe(q historyQuery) chan upgrader.Event {
+	var ch = make(chan upgrader.Event, streamQueue)
+	s.mutex.Lock()
+	s.subscribers[ch] = q
+	s.mutex.Unlock()
+	return ch
+}
+
+func (s *eventStream) unsubscribe(ch chan upgrader.Event) {
+	s.mutex.Lock()
+	delete(s.subscribers, ch)
+	s.mutex.Unlock()
+}
+
+// handleEventStream serves GET /events/stream?name=&type=, writing each
+// matching event as one line of JSON as it happens, and an empty line now and
+// then so that clients notice a dead connection.
+func (p *program) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	var flusher, ok = w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var values = r.URL.Query()
+	var ch = p.stream.subscribe(historyQuery{Name: values.Get(`name`), Type: values.Get(`type`)})
+	defer p.stream.unsubscribe(ch)
+	w.Header().Set(`Content-Type`, `application/x-ndjson`)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	var encoder = json.NewEncoder(w)
+	var ticker = time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case event := <-ch:
+			err = encoder.Encode(event)
+		case <-ticker.C:
+			_, err = w.Write([]byte("\n"))
+		case <-r.Context().Done():
+			return
+		case <-p.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,258 @@
+package upgrader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	fetcherCache     = `cache`
+	verifierChecksum = `checksum`
+
+	cacheEntryFile = `entry.json`
+)
+
+type cacheEntry struct {
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	Url      string    `json:"url"`
+	Checksum string    `json:"checksum,omitempty"`
+	File     string    `json:"file"`
+	Created  time.Time `json:"created"`
+}
+
+type downloadCache struct {
+	dir     string
+	keep    int
+	limiter *utils.RateLimiter
+}
+
+func cacheKey(uri, checksum, version string) string {
+	var sum = sha256.Sum256([]byte(uri + "\n" + strings.ToLower(checksum) + "\n" + version))
+	return hex.EncodeToString(sum[:16])
+}
+
+func init() {
+	RegisterFetcher(fetcherCache, func(u *Upgrader, pkg *Package) (Fetcher, error) {
+		return &cacheFetcher{u: u, pkg: pkg}, nil
+	})
+	RegisterVerifier(verifierChecksum, func(u *Upgrader, pkg *Package) (Verifier, error) {
+		return checksumVerifier{}, nil
+	})
+}
+
+// cacheFetcher downloads artifacts from their mirrors into the download
+// cache, resuming interrupted downloads, and reuses cached files that still
+// pass verification.
+type cacheFetcher struct {
+	u   *Upgrader
+	pkg *Package
+}
+
+func (f *cacheFetcher) Fetch(ctx context.Context, release Release, artifact Artifact) (filename string, err error) {
+	var c = f.u.cache
+	var uri = artifact.Uris.Primary()
+	var dir = filepath.Join(c.dir, cacheKey(uri, artifact.Checksum, release.Version))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if filename, err = artifact.name(); err != nil {
+		return
+	}
+	filename = filepath.Join(dir, filename)
+	if _, e := os.Stat(filename); e == nil {
+		if err = f.pkg.verifier.Verify(ctx, artifact, filename); err == nil {
+			f.u.log(logging.Debug, `using cached package `+filename, logging.Fields{Package: f.pkg.Name, Version: release.Version, Phase: phaseDownload})
+			return
+		}
+		_ = os.Remove(filename)
+	}
+	if err = f.patch(ctx, release, artifact, filename); err != nil {
+		if err != errNoPatch && !IsCancelled(err) {
+			f.u.log(logging.Warning, `patch failed, downloading the full package`, logging.Fields{Package: f.pkg.Name, Version: release.Version, Phase: phasePatch, Error: err.Error()})
+		}
+		if err = f.download(ctx, release, artifact, filename); err != nil {
+			return
+		}
+	}
+	err = utils.WriteJsonFile(filepath.Join(dir, cacheEntryFile), cacheEntry{
+		Package:  f.pkg.Name,
+		Version:  release.Version,
+		Url:      uri,
+		Checksum: artifact.Checksum,
+		File:     filepath.Base(filename),
+		Created:  time.Now(),
+	})
+	if e := c.prune(f.pkg.Name); e != nil {
+		f.u.log(logging.Warning, `prune download cache failed`, logging.Fields{Package: f.pkg.Name, Phase: phaseDownload, Error: e.Error()})
+	}
+	return
+}
+
+func (f *cacheFetcher) download(ctx context.Context, release Release, artifact Artifact, filename string) (err error) {
+	var started = time.Now()
+	var source string
+	err = f.u.mirrors.try(artifact.Uris, f.pkg.MirrorStrategy, func(uri string) (err error) {
+		if err = f.pkg.client.ResumeDownload(ctx, filename, uri, f.u.cache.limiter, f.pkg.limiter); err == nil {
+			if err = f.pkg.verifier.Verify(ctx, artifact, filename); err != nil {
+				_ = os.Remove(filename)
+			}
+		}
+		source = uri
+		return
+	})
+	f.notifyDownload(release, artifact, source, filename, started, err)
+	return
+}
+
+// notifyDownload reports a finished or failed transfer of filename from uri.
+func (f *cacheFetcher) notifyDownload(release Release, artifact Artifact, uri, filename string, started time.Time, err error) {
+	var event = Event{
+		Type:     EventDownloadSucceeded,
+		Package:  f.pkg.Name,
+		Version:  release.Version,
+		Url:      uri,
+		Checksum: artifact.Checksum,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		if IsCancelled(err) {
+			return
+		}
+		event.Type, event.Error = EventDownloadFailed, err.Error()
+	} else if info, e := os.Stat(filename); e == nil {
+		event.Bytes = info.Size()
+	}
+	f.u.Notify(event)
+}
+
+type checksumVerifier struct{}
+
+func (checksumVerifier) Verify(ctx context.Context, artifact Artifact, filename string) error {
+	return verifyChecksum(filename, artifact.Checksum)
+}
+
+func (c *downloadCache) entries(packageName string) (entries []cacheEntry) {
+	var list, err = ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, item := range list {
+		var entry cacheEntry
+		if item.IsDir() && utils.ReadJsonFile(filepath.Join(c.dir, item.Name(), cacheEntryFile), &entry) && entry.Package == packageName {
+			entry.File = filepath.Join(c.dir, item.Name(), entry.File)
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.After(entries[j].Created)
+	})
+	return
+}
+
+// prune removes cached versions of packageName beyond the newest keep and
+// returns the last error.
+func (c *downloadCache) prune(packageName string) (err error) {
+	var versions = make(map[string]bool)
+	for _, entry := range c.entries(packageName) {
+		if !versions[entry.Version] && len(versions) < c.keep {
+			versions[entry.Version] = true
+		}
+		if !versions[entry.Version] {
+			if e := os.RemoveAll(filepath.Dir(entry.File)); e != nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// parseChecksum accepts a bare checksum or sha256sum output listing several
+// files, in which case the line for filename is used.
+func parseChecksum(content, filename string) string {
+	var first string
+	for _, line := range strings.Split(content, "\n") {
+		var fields = strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if first == `` {
+			first = fields[0]
+		}
+		if len(fields) > 1 && strings.TrimPrefix(fields[1], `*`) == filename {
+			return fields[0]
+		}
+	}
+	return first
+}
+
+// name returns the file name the artifact is saved under in the cache. The
+// name comes from the server, so anything but a plain file name is refused.
+func (a Artifact) name() (filename string, err error) {
+	filename = a.Filename
+	if filename == `` {
+		if filename, err = uriFilename(a.Uris.Primary()); err != nil {
+			return
+		}
+	}
+	if filename == `` || filename == `.` || filename == `..` || strings.ContainsAny(filename, `/\`) || filename != filepath.Base(filename) {
+		return ``, fmt.Errorf(`invalid artifact file name %q`, filename)
+	}
+	return
+}
+
+func uriFilename(uri string) (filename string, err error) {
+	if local, ok := utils.LocalPath(uri); ok {
+		filename = filepath.Base(local)
+		return
+	}
+	var u *url.URL
+	if u, err = url.Parse(uri); err == nil {
+		filename = path.Base(u.Path)
+	}
+	return
+}
+
+func verifyChecksum(filename, checksum string) (err error) {
+	if checksum == `` {
+		return
+	}
+	var sum string
+	if strings.HasPrefix(checksum, `md5:`) {
+		checksum = checksum[4:]
+		sum, err = utils.FileMd5(filename)
+	} else {
+		sum, err = utils.FileSha256(filename)
+	}
+	if err == nil && !strings.EqualFold(sum, checksum) {
+		err = fmt.Errorf(`checksum mismatch for %s: expected %s, got %s`, filepath.Base(filename), checksum, sum)
+	}
+	return
+}
+
+func (u *Upgrader) requestChecksum(ctx context.Context, pkg *Package, artifact Artifact) (checksum string, err error) {
+	if artifact.Checksum != `` {
+		checksum = artifact.Checksum
+	} else if artifact.ChecksumUri != `` {
+		var content, filename string
+		if content, _, err = pkg.client.RequestText(ctx, artifact.ChecksumUri, `GET`, ``); err == nil {
+			if filename, err = artifact.name(); err == nil {
+				checksum = parseChecksum(content, filename)
+			}
+		}
+	}
+	return
+}
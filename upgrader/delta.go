@@ -0,0 +1,76 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const patchBsdiff = `bsdiff`
+
+var errNoPatch = errors.New(`no usable patch`)
+
+// patchFrom returns the patch whose base is the given installed version.
+func (r Release) patchFrom(installed string) (patch Patch, ok bool) {
+	for _, patch = range r.Patches {
+		if comp, valid := version.CompareVersion(patch.From, installed); valid && comp == 0 {
+			return patch, true
+		}
+	}
+	return Patch{}, false
+}
+
+// patch builds the package of release into filename by applying the patch
+// from the installed version to the cached full package of that version. It
+// returns errNoPatch when the release offers no patch, the base is not cached
+// or the result could not be checked against the full package's checksum.
+func (f *cacheFetcher) patch(ctx context.Context, release Release, artifact Artifact, filename string) (err error) {
+	if len(release.Artifacts) != 1 || artifact.Checksum == `` {
+		return errNoPatch
+	}
+	var state, _ = f.u.state.Get(f.pkg.Name)
+	var patch, ok = release.patchFrom(state.LocalVersion)
+	if !ok {
+		return errNoPatch
+	}
+	var base string
+	for _, entry := range f.u.cache.entries(f.pkg.Name) {
+		if entry.Version == patch.From {
+			if _, e := os.Stat(entry.File); e == nil {
+				base = entry.File
+				break
+			}
+		}
+	}
+	if base == `` {
+		return errNoPatch
+	}
+	if patch.Format != `` && patch.Format != patchBsdiff {
+		return fmt.Errorf(`unsupported patch format: %s`, patch.Format)
+	}
+	var patchFile = filename + `.patch`
+	defer os.Remove(patchFile)
+	var started = time.Now()
+	if err = f.pkg.client.ResumeDownload(ctx, patchFile, patch.Uri, f.u.cache.limiter, f.pkg.limiter); err == nil {
+		err = verifyChecksum(patchFile, patch.Sha256)
+	}
+	f.notifyDownload(release, Artifact{Checksum: patch.Sha256}, patch.Uri, patchFile, started, err)
+	if err != nil {
+		return
+	}
+	if err = utils.Bspatch(ctx, base, patchFile, filename); err == nil {
+		err = f.pkg.verifier.Verify(ctx, artifact, filename)
+	}
+	if err != nil {
+		_ = os.Remove(filename)
+		return
+	}
+	f.u.log(logging.Info, `applied patch from `+patch.From, logging.Fields{Package: f.pkg.Name, Version: release.Version, Phase: phasePatch, Duration: time.Since(started)})
+	return
+}
@@ -0,0 +1,74 @@
+package upgrader
+
+import (
+	"io"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventCheckSucceeded    EventType = `check.succeeded`
+	EventCheckFailed       EventType = `check.failed`
+	EventDownloadSucceeded EventType = `download.succeeded`
+	EventDownloadFailed    EventType = `download.failed`
+	EventUpgradeStarted    EventType = `upgrade.started`
+	EventUpgradeStaged     EventType = `upgrade.staged`
+	EventUpgradeSucceeded  EventType = `upgrade.succeeded`
+	EventUpgradeFailed     EventType = `upgrade.failed`
+	EventRolledBack        EventType = `upgrade.rolledback`
+	EventServiceRestarted  EventType = `service.restarted`
+	EventServiceGaveUp     EventType = `service.gave_up`
+)
+
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Package string    `json:"package,omitempty"`
+	Service string    `json:"service,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	// Url, Checksum and Bytes describe a download, Duration the time a
+	// download or upgrade took.
+	Url      string        `json:"url,omitempty"`
+	Checksum string        `json:"checksum,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// AddNotifier subscribes n to every event emitted from now on.
+func (u *Upgrader) AddNotifier(n Notifier) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.notifiers = append(u.notifiers, n)
+}
+
+// CloseNotifiers closes the notifiers that are io.Closers, letting them
+// deliver what they hold back. It is called once when the program stops.
+func (u *Upgrader) CloseNotifiers() (err error) {
+	u.mutex.Lock()
+	var notifiers = u.notifiers
+	u.mutex.Unlock()
+	for _, n := range notifiers {
+		if closer, ok := n.(io.Closer); ok {
+			if e := closer.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// Notify stamps event with the current time if unset and passes it to every
+// notifier.
+func (u *Upgrader) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	u.mutex.Lock()
+	var notifiers = u.notifiers
+	u.mutex.Unlock()
+	for _, n := range notifiers {
+		n.Notify(event)
+	}
+}
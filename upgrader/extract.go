@@ -0,0 +1,47 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const extractorArchive = `archive`
+
+var archiveExtensions = []string{`.tar.gz`, `.tgz`, `.zip`, `.gz`, `.tar`}
+
+func init() {
+	RegisterExtractor(extractorArchive, func(u *Upgrader, pkg *Package) (Extractor, error) {
+		return archiveExtractor{}, nil
+	})
+}
+
+func archiveType(filename string) string {
+	var lower = strings.ToLower(filename)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ``
+}
+
+// archiveExtractor unpacks zip, tar and gzip compressed tar archives by file
+// extension.
+type archiveExtractor struct{}
+
+func (archiveExtractor) Extract(ctx context.Context, packageFile, destDir string) (err error) {
+	switch archiveType(packageFile) {
+	case `.zip`:
+		err = utils.Unzip(packageFile, destDir)
+	case `.tar.gz`, `.tgz`, `.gz`:
+		err = utils.ExtractGzip(packageFile, destDir)
+	case `.tar`:
+		err = utils.ExtractTar(packageFile, destDir)
+	default:
+		err = errors.New(`not supported type`)
+	}
+	return
+}
@@ -0,0 +1,230 @@
+package upgrader
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	installerCopy   = `copy`
+	installerStaged = `staged`
+
+	stagedRetryBase = 10 * time.Second
+	stagedRetryMax  = 30 * time.Minute
+)
+
+type UpgradeReadyInfo struct {
+	WorkDirectory string `json:"workDirectory"`
+	PackageDir    string `json:"package_dir"`
+	Version       string `json:"version"`
+	// Files lists the paths of a release synced from the blob store.
+	Files []string `json:"files,omitempty"`
+	// Failures counts failed attempts to apply the upgrade; it is not
+	// applied from upgrade.ok again before RetryAt.
+	Failures int       `json:"failures,omitempty"`
+	RetryAt  time.Time `json:"retryAt,omitempty"`
+}
+
+func init() {
+	RegisterInstaller(installerCopy, func(u *Upgrader, pkg *Package) (Installer, error) {
+		return &copyInstaller{u: u, pkg: pkg}, nil
+	})
+	RegisterInstaller(installerStaged, func(u *Upgrader, pkg *Package) (Installer, error) {
+		return &stagedInstaller{u: u, pkg: pkg}, nil
+	})
+}
+
+// copyInstaller copies the files over WorkDirectory, rolling back on failure.
+type copyInstaller struct {
+	u   *Upgrader
+	pkg *Package
+}
+
+func (i *copyInstaller) Install(ctx context.Context, release Release, dir string) (staged bool, err error) {
+	if !i.u.Installs.Acquire(ctx) {
+		err = ErrStopping
+		return
+	}
+	defer i.u.Installs.Release()
+	err = i.u.installFiles(ctx, i.pkg.Name, dir, i.pkg.WorkDirectory, filePaths(release.Files))
+	return
+}
+
+// installFiles puts dir into workDirectory. A directory synced from the blob
+// store, for which files lists every path of the release, only holds the
+// changed files; they are swapped in and the files of the installed release
+// that files no longer lists are removed. Any other directory is copied over.
+func (u *Upgrader) installFiles(ctx context.Context, name, dir, workDirectory string, files []string) error {
+	if len(files) == 0 {
+		return utils.InstallFiles(u.installContext(ctx), dir, workDirectory)
+	}
+	var state, _ = u.state.Get(name)
+	return utils.SwapFiles(u.installContext(ctx), dir, workDirectory, removedFiles(state.Files, files))
+}
+
+// stagedInstaller keeps the upgrade in the state and publishes it in the
+// upgrade.ready file for applications that have to shut down before their
+// files can be replaced.
+type stagedInstaller struct {
+	u   *Upgrader
+	pkg *Package
+}
+
+func (i *stagedInstaller) Install(ctx context.Context, release Release, dir string) (staged bool, err error) {
+	var previous string
+	i.u.state.Update(i.pkg.Name, func(state *PackageState) {
+		if state.Staged != nil {
+			previous = state.Staged.PackageDir
+		}
+		state.Staged = &UpgradeReadyInfo{
+			WorkDirectory: i.pkg.WorkDirectory,
+			PackageDir:    dir,
+			Version:       release.Version,
+			Files:         filePaths(release.Files),
+		}
+	})
+	if previous != `` && previous != dir {
+		_ = os.RemoveAll(previous)
+	}
+	if err = i.u.state.Save(); err == nil {
+		err = i.u.publishStaged()
+	}
+	staged = err == nil
+	return
+}
+
+// publishStaged writes the staged upgrades to the upgrade.ready file, or
+// removes it when there are none, holding the lock shared with
+// applications.
+func (u *Upgrader) publishStaged() (err error) {
+	var unlock func()
+	if unlock, err = utils.LockFile(u.readyFile); err != nil {
+		return
+	}
+	defer unlock()
+	if staged := u.state.staged(); len(staged) > 0 {
+		return utils.WriteJsonFile(u.readyFile, staged)
+	}
+	if err = os.Remove(u.readyFile); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// migrateReadyFile moves upgrades staged by earlier versions, which kept
+// them only in the upgrade.ready file, into the state.
+func (u *Upgrader) migrateReadyFile() {
+	var state = u.state
+	state.mutex.Lock()
+	var current = state.Version >= stateVersion
+	state.mutex.Unlock()
+	if current {
+		return
+	}
+	var upgradeReadyInfo map[string]UpgradeReadyInfo
+	if unlock, err := utils.LockFile(u.readyFile); err == nil {
+		utils.ReadJsonFile(u.readyFile, &upgradeReadyInfo)
+		unlock()
+	}
+	for name, info := range upgradeReadyInfo {
+		var info = info
+		if _, err := os.Stat(info.PackageDir); err != nil {
+			continue
+		}
+		state.Update(name, func(state *PackageState) {
+			if state.Staged == nil {
+				state.Staged = &info
+			}
+		})
+		u.log(logging.Info, `migrated staged upgrade`, logging.Fields{Package: name, Version: info.Version, Phase: phaseInstall})
+	}
+	state.mutex.Lock()
+	state.Version = stateVersion
+	state.mutex.Unlock()
+	var err = state.Save()
+	if err == nil {
+		err = u.publishStaged()
+	}
+	if err != nil {
+		u.log(logging.Error, `migrate staged upgrades failed`, logging.Fields{Phase: phaseInstall, Error: err.Error()})
+	}
+}
+
+// Staged returns the staged upgrade of the named package, if any.
+func (u *Upgrader) Staged(name string) (info UpgradeReadyInfo, ok bool) {
+	var state PackageState
+	if state, ok = u.state.Get(name); ok && state.Staged != nil {
+		return *state.Staged, true
+	}
+	return info, false
+}
+
+// ApplyStaged installs the staged upgrade of the named package and removes it
+// from the state and the upgrade.ready file. applied is false when nothing
+// was staged.
+func (u *Upgrader) ApplyStaged(ctx context.Context, name string) (applied bool, err error) {
+	if !u.Installs.Acquire(ctx) {
+		err = ErrStopping
+		return
+	}
+	defer u.Installs.Release()
+	var info, ok = u.Staged(name)
+	if !ok {
+		return
+	}
+	if err = u.installFiles(ctx, name, info.PackageDir, info.WorkDirectory, info.Files); err != nil {
+		if !IsCancelled(err) && u.stagedFailed(name, info.Version) {
+			u.Notify(Event{Type: EventUpgradeFailed, Package: name, Version: info.Version, Error: err.Error()})
+		}
+		return
+	}
+	applied = true
+	_ = os.RemoveAll(info.PackageDir)
+	u.state.Update(name, func(state *PackageState) {
+		state.LocalVersion = info.Version
+		state.LastUpgrade = time.Now()
+		state.Files = info.Files
+		state.Staged = nil
+	})
+	if err = u.state.Save(); err == nil {
+		err = u.publishStaged()
+	}
+	u.log(logging.Info, `upgrade completed`, logging.Fields{Package: name, Version: info.Version, Phase: phaseInstall})
+	u.Notify(Event{Type: EventUpgradeSucceeded, Package: name, Version: info.Version})
+	return
+}
+
+// stagedFailed records a failed attempt to apply the staged version of the
+// named package and holds further attempts back, doubling the delay from
+// stagedRetryBase up to stagedRetryMax. It reports whether this was the
+// first failure of the version, which alone is notified.
+func (u *Upgrader) stagedFailed(name, version string) (first bool) {
+	u.state.Update(name, func(state *PackageState) {
+		if state.Staged == nil || state.Staged.Version != version {
+			return
+		}
+		var staged = *state.Staged
+		first = staged.Failures == 0
+		var delay = stagedRetryMax
+		if staged.Failures < 16 {
+			if delay = stagedRetryBase << staged.Failures; delay > stagedRetryMax {
+				delay = stagedRetryMax
+			}
+		}
+		staged.Failures++
+		staged.RetryAt = time.Now().Add(delay)
+		state.Staged = &staged
+	})
+	var err = u.state.Save()
+	if err == nil {
+		err = u.publishStaged()
+	}
+	if err != nil {
+		u.log(logging.Error, `save staged upgrade failed`, logging.Fields{Package: name, Phase: phaseInstall, Error: err.Error()})
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package upgrader
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder keeps the events it is notified of.
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Notify(event Event) {
+	r.mutex.Lock()
+	r.events = append(r.events, event)
+	r.mutex.Unlock()
+}
+
+func (r *eventRecorder) count(eventType EventType) (n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, event := range r.events {
+		if event.Type == eventType {
+			n++
+		}
+	}
+	return
+}
+
+func TestApplyStagedFailure(t *testing.T) {
+	var u = newTestUpgrader(t)
+	var events = &eventRecorder{}
+	u.AddNotifier(events)
+	var pkg = newTestPackage(t, `1.0.0`)
+	pkg.Source.Type, pkg.DropFolder, pkg.NeedShutdown = sourceDropFolder, t.TempDir(), true
+	// A work directory that is a file cannot take the upgrade.
+	pkg.WorkDirectory = filepath.Join(pkg.WorkDirectory, `app`)
+	if err := ioutil.WriteFile(pkg.WorkDirectory, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Prepare(pkg); err != nil {
+		t.Fatal(err)
+	}
+	var stage = func(version string) {
+		var dir = t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, `app.txt`), []byte(version), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if staged, err := u.Install(context.Background(), pkg, Release{Version: version}, dir); err != nil || !staged {
+			t.Fatalf(`staging %s: %t, %v`, version, staged, err)
+		}
+	}
+
+	stage(`1.1.0`)
+	var delays []time.Duration
+	for i := 0; i < 3; i++ {
+		if applied, err := u.ApplyStaged(context.Background(), pkg.Name); applied || err == nil {
+			t.Fatalf(`apply %d: %t, %v, want a failure`, i, applied, err)
+		}
+		var info, _ = u.Staged(pkg.Name)
+		if info.Failures != i+1 {
+			t.Errorf(`apply %d: %d failures recorded`, i, info.Failures)
+		}
+		delays = append(delays, time.Until(info.RetryAt))
+	}
+	if !(delays[0] > 0 && delays[1] > delays[0] && delays[2] > delays[1]) {
+		t.Errorf(`retry delays %v do not grow`, delays)
+	}
+	if n := events.count(EventUpgradeFailed); n != 1 {
+		t.Errorf(`%d upgrade.failed events for one staged version, want 1`, n)
+	}
+
+	stage(`1.2.0`)
+	if info, _ := u.Staged(pkg.Name); info.Failures != 0 || !info.RetryAt.IsZero() {
+		t.Errorf(`a new staged version inherited failures %d, retry at %s`, info.Failures, info.RetryAt)
+	}
+	_, _ = u.ApplyStaged(context.Background(), pkg.Name)
+	if n := events.count(EventUpgradeFailed); n != 2 {
+		t.Errorf(`%d upgrade.failed events for two staged versions, want 2`, n)
+	}
+}
+
+func TestStagedRetryDelayCapped(t *testing.T) {
+	var u = newTestUpgrader(t)
+	u.state.Update(`app`, func(state *PackageState) {
+		state.Staged = &UpgradeReadyInfo{Version: `1.1.0`, Failures: 40}
+	})
+	u.stagedFailed(`app`, `1.1.0`)
+	if info, _ := u.Staged(`app`); time.Until(info.RetryAt) > stagedRetryMax {
+		t.Errorf(`retry at %s is beyond %s`, info.RetryAt, stagedRetryMax)
+	}
+}
@@ -0,0 +1,167 @@
+package upgrader
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	mirrorOrdered = `ordered`
+	mirrorRandom  = `random`
+
+	mirrorBlacklistBase = time.Minute
+	mirrorBlacklistMax  = 30 * time.Minute
+)
+
+type UriList []string
+
+func (l *UriList) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var uri string
+	if err = unmarshal(&uri); err == nil {
+		*l = UriList{uri}
+		return
+	}
+	var list []string
+	if err = unmarshal(&list); err == nil {
+		*l = list
+	}
+	return
+}
+
+func (l UriList) Primary() string {
+	if len(l) > 0 {
+		return l[0]
+	}
+	return ``
+}
+
+type mirrorStatus struct {
+	Failures         int       `json:"failures"`
+	LastError        string    `json:"lastError,omitempty"`
+	BlacklistedUntil time.Time `json:"blacklistedUntil,omitempty"`
+}
+
+type mirrorHealth struct {
+	mutex   sync.Mutex
+	mirrors map[string]*mirrorStatus
+}
+
+type mirrorFailure struct {
+	uri string
+	err error
+}
+
+type MirrorError struct {
+	failures []mirrorFailure
+}
+
+func (e *MirrorError) Error() string {
+	if len(e.failures) == 1 {
+		return e.failures[0].err.Error()
+	}
+	var buffer = make([]string, 0, len(e.failures))
+	for _, item := range e.failures {
+		buffer = append(buffer, fmt.Sprintf(`%s: %s`, item.uri, item.err))
+	}
+	return fmt.Sprintf(`all %d mirrors failed: %s`, len(e.failures), strings.Join(buffer, `; `))
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{mirrors: make(map[string]*mirrorStatus)}
+}
+
+func (h *mirrorHealth) order(uris UriList, strategy string) []string {
+	var candidates = make([]string, len(uris))
+	copy(candidates, uris)
+	if strategy == mirrorRandom {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var now = time.Now()
+	var healthy, blacklisted []string
+	for _, uri := range candidates {
+		if status, ok := h.mirrors[uri]; ok && status.BlacklistedUntil.After(now) {
+			blacklisted = append(blacklisted, uri)
+		} else {
+			healthy = append(healthy, uri)
+		}
+	}
+	if len(healthy) == 0 {
+		return blacklisted
+	}
+	return healthy
+}
+
+func (h *mirrorHealth) report(uri string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err == nil {
+		delete(h.mirrors, uri)
+		return
+	}
+	var status, ok = h.mirrors[uri]
+	if !ok {
+		status = &mirrorStatus{}
+		h.mirrors[uri] = status
+	}
+	status.Failures++
+	status.LastError = err.Error()
+	var blacklist = mirrorBlacklistBase << uint(status.Failures-1)
+	if blacklist > mirrorBlacklistMax || blacklist <= 0 {
+		blacklist = mirrorBlacklistMax
+	}
+	if delay, ok := retryDelay(err); ok && delay > blacklist {
+		blacklist = delay
+	}
+	status.BlacklistedUntil = time.Now().Add(blacklist)
+}
+
+func (h *mirrorHealth) try(uris UriList, strategy string, fn func(uri string) error) (err error) {
+	var failures []mirrorFailure
+	for _, uri := range h.order(uris, strategy) {
+		if err = fn(uri); err == nil {
+			h.report(uri, nil)
+			return
+		}
+		if IsCancelled(err) {
+			return
+		}
+		h.report(uri, err)
+		failures = append(failures, mirrorFailure{uri: uri, err: err})
+	}
+	if len(failures) > 0 {
+		err = &MirrorError{failures: failures}
+	}
+	return
+}
+
+const defaultRetryAfter = time.Minute
+
+func retryDelay(err error) (delay time.Duration, ok bool) {
+	switch e := err.(type) {
+	case *utils.StatusError:
+		if ok = e.Throttled(); ok {
+			if delay = e.RetryAfter; delay <= 0 {
+				delay = defaultRetryAfter
+			}
+		}
+	case *MirrorError:
+		for _, item := range e.failures {
+			if d, throttled := retryDelay(item.err); throttled {
+				ok = true
+				if d > delay {
+					delay = d
+				}
+			}
+		}
+	}
+	return
+}
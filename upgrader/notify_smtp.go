@@ -0,0 +1,261 @@
+package upgrader
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	notifierSmtp = `smtp`
+
+	defaultSmtpPort    = 25
+	defaultSmtpWindow  = 5 * time.Minute
+	defaultSmtpTimeout = 30 * time.Second
+	smtpMaxEvents      = 500
+)
+
+var defaultSmtpEvents = []EventType{EventUpgradeFailed, EventRolledBack, EventServiceGaveUp}
+
+// defaultSmtpTemplates render one line of the digest per event.
+var defaultSmtpTemplates = map[EventType]string{
+	EventUpgradeFailed: `{{.Time.Format "2006-01-02 15:04:05"}} upgrade of {{.Package}} to {{.Version}} failed: {{.Error}}`,
+	EventRolledBack:    `{{.Time.Format "2006-01-02 15:04:05"}} {{.Package}} was rolled back to {{.Version}}`,
+	EventServiceGaveUp: `{{.Time.Format "2006-01-02 15:04:05"}} gave up restarting service {{.Service}}: {{.Error}}`,
+	``:                 `{{.Time.Format "2006-01-02 15:04:05"}} {{.Type}} {{.Package}}{{.Service}} {{.Version}} {{.Error}}`,
+}
+
+type SmtpConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port,omitempty"`
+	StartTLS bool   `yaml:"startTLS,omitempty"`
+	// TLS connects with implicit TLS, usually on port 465.
+	TLS      bool     `yaml:"tls,omitempty"`
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Subject  string   `yaml:"subject,omitempty"`
+	// Window is how long events are collected into one digest.
+	Window    time.Duration        `yaml:"window,omitempty"`
+	Events    []EventType          `yaml:"events,omitempty"`
+	Templates map[EventType]string `yaml:"templates,omitempty"`
+}
+
+func init() {
+	RegisterNotifier(notifierSmtp, func(u *Upgrader, config StageConfig) (Notifier, error) {
+		var n = &smtpNotifier{u: u, templates: make(map[EventType]*template.Template)}
+		if err := config.Decode(&n.config); err != nil {
+			return nil, err
+		}
+		if n.config.Host == `` || n.config.From == `` || len(n.config.To) == 0 {
+			return nil, errors.New(`smtp host, from and to are required`)
+		}
+		if n.config.Port == 0 {
+			n.config.Port = defaultSmtpPort
+		}
+		if n.config.Window <= 0 {
+			n.config.Window = defaultSmtpWindow
+		}
+		if len(n.config.Events) == 0 {
+			n.config.Events = defaultSmtpEvents
+		}
+		if n.config.Subject == `` {
+			var hostname, _ = os.Hostname()
+			n.config.Subject = fmt.Sprintf(`daemonupgrader on %s`, hostname)
+		}
+		var texts = make(map[EventType]string)
+		for eventType, text := range defaultSmtpTemplates {
+			texts[eventType] = text
+		}
+		for eventType, text := range n.config.Templates {
+			texts[eventType] = text
+		}
+		for eventType, text := range texts {
+			var err error
+			if n.templates[eventType], err = template.New(string(eventType)).Funcs(templateFuncs).Parse(text); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	})
+}
+
+// smtpNotifier mails matching events as a digest. The first event starts a
+// window; everything arriving within it goes out in one mail. A failed mail
+// is retried with the next window, keeping at most smtpMaxEvents events.
+// Close sends what is pending right away.
+type smtpNotifier struct {
+	u         *Upgrader
+	config    SmtpConfig
+	templates map[EventType]*template.Template
+	sending   sync.Mutex
+	mutex     sync.Mutex
+	pending   []Event
+	dropped   int
+	timer     *time.Timer
+	closed    bool
+}
+
+func (n *smtpNotifier) Notify(event Event) {
+	if !EventFilter(n.config.Events).Match(event.Type) {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.pending = append(n.pending, event)
+	n.trim()
+	if n.timer == nil && !n.closed {
+		n.timer = time.AfterFunc(n.config.Window, n.flush)
+	}
+}
+
+// trim drops the oldest events beyond smtpMaxEvents. The caller holds the mutex.
+func (n *smtpNotifier) trim() {
+	if over := len(n.pending) - smtpMaxEvents; over > 0 {
+		n.pending = append(n.pending[:0:0], n.pending[over:]...)
+		n.dropped += over
+	}
+}
+
+// Close stops the window and mails the pending events, waiting for a mail
+// already being sent.
+func (n *smtpNotifier) Close() error {
+	n.mutex.Lock()
+	n.closed = true
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	n.mutex.Unlock()
+	n.flush()
+	return nil
+}
+
+func (n *smtpNotifier) flush() {
+	n.sending.Lock()
+	defer n.sending.Unlock()
+	n.mutex.Lock()
+	var events, dropped = n.pending, n.dropped
+	n.pending, n.dropped = nil, 0
+	n.mutex.Unlock()
+	if len(events) == 0 && dropped == 0 {
+		return
+	}
+
+	var err = n.send(n.digest(events, dropped), len(events))
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err != nil {
+		n.u.log(logging.Error, `mail to `+n.config.Host+` failed`, logging.Fields{Phase: phaseNotify, Error: err.Error()})
+		n.pending = append(events, n.pending...)
+		n.dropped += dropped
+		n.trim()
+	}
+	if len(n.pending) > 0 && !n.closed {
+		n.timer = time.AfterFunc(n.config.Window, n.flush)
+	} else {
+		n.timer = nil
+	}
+}
+
+func (n *smtpNotifier) digest(events []Event, dropped int) string {
+	var body strings.Builder
+	for _, event := range events {
+		var t, ok = n.templates[event.Type]
+		if !ok {
+			t = n.templates[``]
+		}
+		if err := t.Execute(&body, event); err != nil {
+			fmt.Fprintf(&body, `%s %s: %s`, event.Type, event.Package+event.Service, err)
+		}
+		body.WriteString("\r\n")
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&body, "\r\n%d older events were dropped.\r\n", dropped)
+	}
+	return body.String()
+}
+
+func (n *smtpNotifier) message(body string, count int) []byte {
+	var subject = fmt.Sprintf(`%s: %d events`, n.config.Subject, count)
+	if count == 1 {
+		subject = fmt.Sprintf(`%s: 1 event`, n.config.Subject)
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.config.To, `, `))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode(`utf-8`, subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(body)
+	return []byte(message.String())
+}
+
+func (n *smtpNotifier) send(body string, count int) (err error) {
+	var address = net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	var tlsConfig = &tls.Config{ServerName: n.config.Host}
+	var conn net.Conn
+	var dialer = &net.Dialer{Timeout: defaultSmtpTimeout}
+	if n.config.TLS {
+		conn, err = tls.DialWithDialer(dialer, `tcp`, address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(`tcp`, address)
+	}
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(defaultSmtpTimeout))
+	var client *smtp.Client
+	if client, err = smtp.NewClient(conn, n.config.Host); err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer client.Close()
+	if n.config.StartTLS {
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return
+		}
+	}
+	if n.config.Username != `` {
+		var password string
+		if password, err = utils.ResolveSecret(n.config.Password); err != nil {
+			return
+		}
+		if err = client.Auth(smtp.PlainAuth(``, n.config.Username, password, n.config.Host)); err != nil {
+			return
+		}
+	}
+	if err = client.Mail(n.config.From); err != nil {
+		return
+	}
+	for _, to := range n.config.To {
+		if err = client.Rcpt(to); err != nil {
+			return
+		}
+	}
+	var w io.WriteCloser
+	if w, err = client.Data(); err != nil {
+		return
+	}
+	if _, err = w.Write(n.message(body, count)); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return client.Quit()
+}
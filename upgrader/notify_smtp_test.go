@@ -0,0 +1,185 @@
+package upgrader
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// smtpServer is a local SMTP server accepting the user app with the password
+// secret. It refuses MAIL FROM in the first failures sessions.
+type smtpServer struct {
+	listener net.Listener
+	messages chan string
+	mutex    sync.Mutex
+	failures int
+}
+
+func newSmtpServer(t *testing.T, failures int) *smtpServer {
+	var listener, err = net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &smtpServer{listener: listener, messages: make(chan string, 10), failures: failures}
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var text = textproto.NewConn(conn)
+	var reply = func(line string) bool {
+		return text.PrintfLine(`%s`, line) == nil
+	}
+	s.mutex.Lock()
+	var fail = s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mutex.Unlock()
+	var authenticated bool
+	reply(`220 localhost ESMTP`)
+	for {
+		var line, err = text.ReadLine()
+		if err != nil {
+			return
+		}
+		var command = strings.ToUpper(strings.SplitN(line, ` `, 2)[0])
+		switch {
+		case command == `EHLO`:
+			reply("250-localhost\r\n250 AUTH PLAIN")
+		case command == `AUTH`:
+			var credentials, _ = base64.StdEncoding.DecodeString(strings.TrimPrefix(line, `AUTH PLAIN `))
+			if authenticated = string(credentials) == "\x00app\x00secret"; authenticated {
+				reply(`235 authenticated`)
+			} else {
+				reply(`535 invalid credentials`)
+			}
+		case command == `MAIL` && fail:
+			reply(`451 try again later`)
+		case command == `MAIL` && !authenticated:
+			reply(`530 authentication required`)
+		case command == `MAIL` || command == `RCPT`:
+			reply(`250 ok`)
+		case command == `DATA`:
+			reply(`354 go ahead`)
+			var message, _ = ioutil.ReadAll(text.DotReader())
+			s.messages <- string(message)
+			reply(`250 queued`)
+		case command == `QUIT`:
+			reply(`221 bye`)
+			return
+		default:
+			reply(`502 not implemented`)
+		}
+	}
+}
+
+// receive waits for the next message.
+func (s *smtpServer) receive(t *testing.T) string {
+	select {
+	case message := <-s.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no mail received`)
+		return ``
+	}
+}
+
+func newSmtpNotifier(t *testing.T, u *Upgrader, s *smtpServer, window time.Duration) Notifier {
+	t.Setenv(`DAEMONUPGRADER_TEST_SMTP_PASSWORD`, `secret`)
+	var config StageConfig
+	var err = yaml.Unmarshal([]byte(fmt.Sprintf(`
+type: smtp
+host: 127.0.0.1
+port: %d
+username: app
+password: env:DAEMONUPGRADER_TEST_SMTP_PASSWORD
+from: upgrader@example.com
+to: [ops@example.com]
+subject: upgrades
+window: %s
+`, s.port(), window)), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n Notifier
+	if n, err = u.NewNotifier(config); err != nil {
+		t.Fatal(err)
+	}
+	u.AddNotifier(n)
+	return n
+}
+
+func TestSmtpDigestOnClose(t *testing.T) {
+	var s = newSmtpServer(t, 0)
+	var u = newTestUpgrader(t)
+	var n = newSmtpNotifier(t, u, s, time.Hour)
+	n.Notify(Event{Type: EventCheckSucceeded, Package: `app`})
+	n.Notify(Event{Type: EventUpgradeFailed, Package: `app`, Version: `1.2.0`, Error: `disk full`})
+	n.Notify(Event{Type: EventRolledBack, Package: `app`, Version: `1.1.0`})
+	select {
+	case message := <-s.messages:
+		t.Fatalf(`mail sent before the window closed: %s`, message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := u.CloseNotifiers(); err != nil {
+		t.Fatal(err)
+	}
+	var message = s.receive(t)
+	for _, want := range []string{
+		`Subject: upgrades: 2 events`,
+		`To: ops@example.com`,
+		`upgrade of app to 1.2.0 failed: disk full`,
+		`app was rolled back to 1.1.0`,
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("mail lacks %q:\n%s", want, message)
+		}
+	}
+	if strings.Contains(message, `check.succeeded`) {
+		t.Errorf("mail holds an event that was not selected:\n%s", message)
+	}
+}
+
+func TestSmtpRetry(t *testing.T) {
+	var s = newSmtpServer(t, 1)
+	var u = newTestUpgrader(t)
+	var n = newSmtpNotifier(t, u, s, 50*time.Millisecond)
+	n.Notify(Event{Type: EventServiceGaveUp, Service: `app`, Error: `exit status 1`})
+	var message = s.receive(t)
+	if !strings.Contains(message, `Subject: upgrades: 1 event`) || !strings.Contains(message, `gave up restarting service app: exit status 1`) {
+		t.Errorf("retried mail does not hold the event:\n%s", message)
+	}
+	if err := u.CloseNotifiers(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message = <-s.messages:
+		t.Errorf(`event mailed twice: %s`, message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,237 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+const (
+	notifierWebhook = `webhook`
+
+	defaultWebhookRetries = 3
+	defaultWebhookQueue   = 100
+	webhookRetryDelay     = time.Second
+	webhookMaxRetryDelay  = time.Minute
+	webhookCloseTimeout   = 10 * time.Second
+)
+
+type WebhookConfig struct {
+	Url     string            `yaml:"url"`
+	Method  string            `yaml:"method,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Body is a text/template executed with the Event. The json function
+	// quotes a value for use inside a JSON document. Empty sends the event
+	// itself as JSON.
+	Body    string            `yaml:"body,omitempty"`
+	Events  []EventType       `yaml:"events,omitempty"`
+	Retries *int              `yaml:"retries,omitempty"`
+	Queue   int               `yaml:"queue,omitempty"`
+	Http    utils.HttpOptions `yaml:"http,omitempty"`
+}
+
+// EventFilter matches event types against a list of patterns such as
+// upgrade.failed or service.*. An empty filter matches everything.
+type EventFilter []EventType
+
+func (f EventFilter) Match(t EventType) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, pattern := range f {
+		if ok, _ := path.Match(string(pattern), string(t)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var templateFuncs = template.FuncMap{
+	`json`: func(v interface{}) (string, error) {
+		var buffer, err = json.Marshal(v)
+		return string(buffer), err
+	},
+}
+
+func init() {
+	RegisterNotifier(notifierWebhook, func(u *Upgrader, config StageConfig) (Notifier, error) {
+		var n = &webhookNotifier{u: u, done: make(chan struct{})}
+		n.ctx, n.cancel = context.WithCancel(context.Background())
+		if err := config.Decode(&n.config); err != nil {
+			return nil, err
+		}
+		if n.config.Url == `` {
+			return nil, errors.New(`webhook url is required`)
+		}
+		if n.config.Method == `` {
+			n.config.Method = http.MethodPost
+		}
+		if n.config.Retries == nil {
+			var retries = defaultWebhookRetries
+			n.config.Retries = &retries
+		}
+		if n.config.Queue <= 0 {
+			n.config.Queue = defaultWebhookQueue
+		}
+		var err error
+		if n.config.Body != `` {
+			if n.body, err = template.New(n.config.Url).Funcs(templateFuncs).Parse(n.config.Body); err != nil {
+				return nil, err
+			}
+		}
+		if n.client, err = utils.NewHttpClient(u.http.Merge(n.config.Http)); err != nil {
+			return nil, err
+		}
+		return n, nil
+	})
+}
+
+// webhookNotifier posts matching events to a URL. Events are queued and
+// delivered by a single goroutine, started with the first event; when the
+// queue is full new events are dropped. Close delivers what is queued,
+// giving up after webhookCloseTimeout.
+type webhookNotifier struct {
+	u      *Upgrader
+	config WebhookConfig
+	body   *template.Template
+	client *utils.HttpClient
+	ctx    context.Context
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	queue  chan Event
+	closed bool
+	done   chan struct{}
+}
+
+func (n *webhookNotifier) Notify(event Event) {
+	if !EventFilter(n.config.Events).Match(event.Type) {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return
+	}
+	if n.queue == nil {
+		n.queue = make(chan Event, n.config.Queue)
+		go n.run()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		n.u.log(logging.Warning, fmt.Sprintf(`webhook %s: queue full, dropped %s`, n.config.Url, event.Type), logging.Fields{Package: event.Package, Service: event.Service, Phase: phaseNotify})
+	}
+}
+
+// Close stops taking events and waits for the queued ones to be delivered.
+func (n *webhookNotifier) Close() error {
+	n.mutex.Lock()
+	var started = n.queue != nil
+	if !n.closed && started {
+		close(n.queue)
+	}
+	n.closed = true
+	n.mutex.Unlock()
+	if !started {
+		return nil
+	}
+	select {
+	case <-n.done:
+	case <-time.After(webhookCloseTimeout):
+		n.cancel()
+		<-n.done
+	}
+	n.cancel()
+	return nil
+}
+
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	var dropped int
+	for event := range n.queue {
+		if n.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		if err := n.deliver(event); err != nil {
+			n.u.log(logging.Error, fmt.Sprintf(`webhook %s: %s not delivered`, n.config.Url, event.Type),
+				logging.Fields{Package: event.Package, Service: event.Service, Phase: phaseNotify, Error: err.Error()})
+		}
+	}
+	if dropped > 0 {
+		n.u.log(logging.Warning, fmt.Sprintf(`webhook %s: %d events not delivered before shutdown`, n.config.Url, dropped), logging.Fields{Phase: phaseNotify})
+	}
+}
+
+func (n *webhookNotifier) render(event Event) (string, error) {
+	if n.body == nil {
+		var buffer, err = json.Marshal(event)
+		return string(buffer), err
+	}
+	var body strings.Builder
+	if err := n.body.Execute(&body, event); err != nil {
+		return ``, err
+	}
+	return body.String(), nil
+}
+
+// header resolves the configured headers, read again for every delivery so
+// that rotated secrets are picked up.
+func (n *webhookNotifier) header() (header http.Header, err error) {
+	header = make(http.Header)
+	header.Set(`Content-Type`, `application/json`)
+	for key, value := range n.config.Headers {
+		if value, err = utils.ResolveSecret(value); err != nil {
+			return
+		}
+		header.Set(key, value)
+	}
+	return
+}
+
+// deliver sends event, retrying failed attempts with a growing delay or the
+// delay the server asked for. Client errors other than 429 are not retried.
+func (n *webhookNotifier) deliver(event Event) (err error) {
+	var body string
+	if body, err = n.render(event); err != nil {
+		return
+	}
+	var header http.Header
+	if header, err = n.header(); err != nil {
+		return
+	}
+	var delay = webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		_, err = n.client.Send(n.ctx, n.config.Url, n.config.Method, header, body)
+		if err == nil || attempt >= *n.config.Retries {
+			return
+		}
+		var statusErr *utils.StatusError
+		if errors.As(err, &statusErr) {
+			if statusErr.StatusCode < 500 && !statusErr.Throttled() {
+				return
+			}
+			if statusErr.RetryAfter > 0 {
+				delay = statusErr.RetryAfter
+			}
+		}
+		select {
+		case <-n.ctx.Done():
+			return n.ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > webhookMaxRetryDelay {
+			delay = webhookMaxRetryDelay
+		}
+	}
+}
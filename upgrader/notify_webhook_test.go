@@ -0,0 +1,59 @@
+package upgrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestWebhookCloseDrainsQueue(t *testing.T) {
+	var mutex sync.Mutex
+	var received []EventType
+	var s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		received = append(received, event.Type)
+		mutex.Unlock()
+	}))
+	defer s.Close()
+	var config StageConfig
+	if err := yaml.Unmarshal([]byte(`{type: webhook, url: "`+s.URL+`"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	var u = newTestUpgrader(t)
+	var n, err = u.NewNotifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AddNotifier(n)
+	var sent = []EventType{EventUpgradeStarted, EventDownloadSucceeded, EventUpgradeSucceeded}
+	for _, eventType := range sent {
+		u.Notify(Event{Type: eventType, Package: `app`})
+	}
+	if err = u.CloseNotifiers(); err != nil {
+		t.Fatal(err)
+	}
+	u.Notify(Event{Type: EventServiceRestarted, Service: `app`})
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != len(sent) {
+		t.Fatalf(`received %v, want %v`, received, sent)
+	}
+	for i := range sent {
+		if received[i] != sent[i] {
+			t.Errorf(`received %v, want %v`, received, sent)
+			break
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package upgrader
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+type Package struct {
+	Name               string               `yaml:"name"`
+	Interval           time.Duration        `yaml:"interval,omitempty"`
+	UriCheckVersion    UriList              `yaml:"uriCheckVersion"`
+	UriDownloadPackage UriList              `yaml:"uriDownloadPackage"`
+	UriBlobs           UriList              `yaml:"uriBlobs,omitempty"`
+	MirrorStrategy     string               `yaml:"mirrorStrategy,omitempty"`
+	DropFolder         string               `yaml:"dropFolder,omitempty"`
+	AllowUnverified    bool                 `yaml:"allowUnverified,omitempty"`
+	Source             StageConfig          `yaml:"source,omitempty"`
+	Fetcher            StageConfig          `yaml:"fetcher,omitempty"`
+	Verifier           StageConfig          `yaml:"verifier,omitempty"`
+	Extractor          StageConfig          `yaml:"extractor,omitempty"`
+	Installer          StageConfig          `yaml:"installer,omitempty"`
+	Gitea              *GiteaReleasesConfig `yaml:"gitea,omitempty"`
+	S3                 *S3Config            `yaml:"s3,omitempty"`
+	Oci                *OciConfig           `yaml:"oci,omitempty"`
+	UriChecksum        string               `yaml:"uriChecksum,omitempty"`
+	WorkDirectory      string               `yaml:"workDirectory"`
+	CommandGetVersion  string               `yaml:"commandGetVersion"`
+	NeedShutdown       bool                 `yaml:"needShutdown,omitempty"`
+	Jitter             *time.Duration       `yaml:"jitter,omitempty"`
+	Http               utils.HttpOptions    `yaml:"http,omitempty"`
+	RateLimit          utils.ByteSize       `yaml:"rateLimit,omitempty"`
+	utils.HttpAuth     `yaml:",inline"`
+	// LocalVersion, when set, reports the installed version instead of
+	// CommandGetVersion.
+	LocalVersion func(ctx context.Context) (string, error) `yaml:"-"`
+
+	client    *utils.HttpClient
+	limiter   *utils.RateLimiter
+	source    VersionSource
+	fetcher   Fetcher
+	verifier  Verifier
+	extractor Extractor
+	installer Installer
+}
+
+func (p *Package) Validate() bool {
+	return p.Name != `` && p.WorkDirectory != `` && (p.CommandGetVersion != `` || p.LocalVersion != nil)
+}
+
+// serverHosts returns the hosts of the update server of the package: those of
+// the first URI of each list and of the endpoint of the source. Mirrors are
+// left out; the credentials of the package are sent to these hosts only
+// unless authHosts is set.
+func (p *Package) serverHosts() (hosts []string) {
+	var server struct {
+		ApiUrl   string `yaml:"apiUrl"`
+		Endpoint string `yaml:"endpoint"`
+		Registry string `yaml:"registry"`
+	}
+	_ = p.Source.Decode(&server)
+	if p.Gitea != nil {
+		server.ApiUrl = p.Gitea.ApiUrl
+	}
+	if p.S3 != nil {
+		server.Endpoint = p.S3.Endpoint
+	}
+	if p.Oci != nil {
+		server.Registry = p.Oci.Registry
+	}
+	if server.ApiUrl == `` && (p.Source.Type == sourceGiteaReleases || p.Source.Type == sourceGithubReleases) {
+		server.ApiUrl = defaultReleasesApiUrl
+	}
+	if server.Registry != `` && !strings.Contains(server.Registry, `://`) {
+		server.Registry = `https://` + server.Registry
+	}
+	for _, uri := range []string{p.UriCheckVersion.Primary(), p.UriDownloadPackage.Primary(), p.UriBlobs.Primary(), p.UriChecksum, server.ApiUrl, server.Endpoint, server.Registry} {
+		if u, err := url.Parse(uri); err == nil && u.Host != `` {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return
+}
+
+// Client returns the HTTP client of the package, with its authentication and
+// any signer installed by the source. It is nil until Upgrader.Prepare.
+func (p *Package) Client() *utils.HttpClient {
+	return p.client
+}
+
+// StageConfig selects the implementation of a pipeline stage. It is written
+// either as the bare type name or as a mapping with a type key followed by
+// the options of that implementation.
+type StageConfig struct {
+	Type string
+
+	node *yaml.Node
+}
+
+func (c *StageConfig) UnmarshalYAML(value *yaml.Node) (err error) {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&c.Type)
+	}
+	var head struct {
+		Type string `yaml:"type"`
+	}
+	if err = value.Decode(&head); err == nil {
+		c.Type, c.node = head.Type, value
+	}
+	return
+}
+
+// Decode fills v with the options written next to type. It leaves v
+// untouched when the stage was given as a bare type name.
+func (c StageConfig) Decode(v interface{}) error {
+	if c.node == nil {
+		return nil
+	}
+	return c.node.Decode(v)
+}
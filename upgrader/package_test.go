@@ -0,0 +1,31 @@
+package upgrader
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestServerHosts(t *testing.T) {
+	var tests = []struct {
+		config string
+		want   string
+	}{
+		{`{uriCheckVersion: [https://updates.example.com/v, https://mirror.example.com/v], uriDownloadPackage: https://dl.example.com:8443/app.zip}`, `updates.example.com dl.example.com:8443`},
+		{`{source: {type: github-releases, owner: team, repo: app, assetPattern: "*.zip"}}`, `api.github.com`},
+		{`{source: gitea-releases, gitea: {apiUrl: "https://gitea.example.com/api/v1"}}`, `gitea.example.com`},
+		{`{source: {type: oci, registry: registry.example.com, repository: team/app}}`, `registry.example.com`},
+		{`{source: s3, s3: {endpoint: "http://minio:9000"}, uriBlobs: [https://blobs.example.com]}`, `blobs.example.com minio:9000`},
+		{`{dropFolder: /srv/drop}`, ``},
+	}
+	for _, test := range tests {
+		var pkg Package
+		if err := yaml.Unmarshal([]byte(test.config), &pkg); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(pkg.serverHosts(), ` `); got != test.want {
+			t.Errorf(`%s: got hosts %q, want %q`, test.config, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package upgrader
+
+import (
+	"context"
+)
+
+const (
+	defaultMaxChecks    = 8
+	defaultMaxDownloads = 2
+	defaultMaxInstalls  = 1
+)
+
+type Concurrency struct {
+	Checks    int `yaml:"checks,omitempty"`
+	Downloads int `yaml:"downloads,omitempty"`
+	Installs  int `yaml:"installs,omitempty"`
+}
+
+// WorkerPool bounds how many tasks of one kind run at the same time.
+type WorkerPool chan struct{}
+
+func NewWorkerPool(size, defaultSize int) WorkerPool {
+	if size < 1 {
+		size = defaultSize
+	}
+	return make(WorkerPool, size)
+}
+
+func (w WorkerPool) Acquire(ctx context.Context) bool {
+	select {
+	case w <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (w WorkerPool) Release() {
+	<-w
+}
+
+// Active returns the number of tasks holding the pool.
+func (w WorkerPool) Active() int {
+	return len(w)
+}
@@ -0,0 +1,207 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// VersionSource finds the latest release of a package.
+type VersionSource interface {
+	Latest(ctx context.Context) (Release, error)
+}
+
+// Fetcher stores an artifact of a release on the local disk and returns the
+// file name. The file must have passed the package's Verifier.
+type Fetcher interface {
+	Fetch(ctx context.Context, release Release, artifact Artifact) (filename string, err error)
+}
+
+// Verifier checks a fetched artifact, typically against its checksum.
+type Verifier interface {
+	Verify(ctx context.Context, artifact Artifact, filename string) error
+}
+
+// Extractor unpacks a fetched artifact into destDir.
+type Extractor interface {
+	Extract(ctx context.Context, filename, destDir string) error
+}
+
+// Installer applies the extracted files in dir to the package. staged
+// reports that the files were handed over to be applied later instead, in
+// which case dir must be left in place.
+type Installer interface {
+	Install(ctx context.Context, release Release, dir string) (staged bool, err error)
+}
+
+// Notifier receives pipeline and service events. Notify must not block.
+type Notifier interface {
+	Notify(event Event)
+}
+
+type (
+	SourceFactory    func(u *Upgrader, pkg *Package) (VersionSource, error)
+	FetcherFactory   func(u *Upgrader, pkg *Package) (Fetcher, error)
+	VerifierFactory  func(u *Upgrader, pkg *Package) (Verifier, error)
+	ExtractorFactory func(u *Upgrader, pkg *Package) (Extractor, error)
+	InstallerFactory func(u *Upgrader, pkg *Package) (Installer, error)
+	NotifierFactory  func(u *Upgrader, config StageConfig) (Notifier, error)
+)
+
+var registry = struct {
+	mutex      sync.RWMutex
+	sources    map[string]SourceFactory
+	fetchers   map[string]FetcherFactory
+	verifiers  map[string]VerifierFactory
+	extractors map[string]ExtractorFactory
+	installers map[string]InstallerFactory
+	notifiers  map[string]NotifierFactory
+}{
+	sources:    make(map[string]SourceFactory),
+	fetchers:   make(map[string]FetcherFactory),
+	verifiers:  make(map[string]VerifierFactory),
+	extractors: make(map[string]ExtractorFactory),
+	installers: make(map[string]InstallerFactory),
+	notifiers:  make(map[string]NotifierFactory),
+}
+
+// RegisterSource makes a VersionSource available as source type name. A
+// later registration with the same name replaces the earlier one, so built-in
+// implementations can be overridden.
+func RegisterSource(name string, factory SourceFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.sources[name] = factory
+}
+
+func RegisterFetcher(name string, factory FetcherFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.fetchers[name] = factory
+}
+
+func RegisterVerifier(name string, factory VerifierFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.verifiers[name] = factory
+}
+
+func RegisterExtractor(name string, factory ExtractorFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.extractors[name] = factory
+}
+
+func RegisterInstaller(name string, factory InstallerFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.installers[name] = factory
+}
+
+func RegisterNotifier(name string, factory NotifierFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.notifiers[name] = factory
+}
+
+// Types lists the registered type names of every stage.
+func Types() map[string][]string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	var types = map[string][]string{
+		`source`:    {},
+		`fetcher`:   {},
+		`verifier`:  {},
+		`extractor`: {},
+		`installer`: {},
+		`notifier`:  {},
+	}
+	for name := range registry.sources {
+		types[`source`] = append(types[`source`], name)
+	}
+	for name := range registry.fetchers {
+		types[`fetcher`] = append(types[`fetcher`], name)
+	}
+	for name := range registry.verifiers {
+		types[`verifier`] = append(types[`verifier`], name)
+	}
+	for name := range registry.extractors {
+		types[`extractor`] = append(types[`extractor`], name)
+	}
+	for name := range registry.installers {
+		types[`installer`] = append(types[`installer`], name)
+	}
+	for name := range registry.notifiers {
+		types[`notifier`] = append(types[`notifier`], name)
+	}
+	for _, names := range types {
+		sort.Strings(names)
+	}
+	return types
+}
+
+func unknownType(stage, name string) error {
+	return fmt.Errorf(`unknown %s type: %s`, stage, name)
+}
+
+func newSource(u *Upgrader, pkg *Package, name string) (VersionSource, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.sources[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`source`, name)
+	}
+	return factory(u, pkg)
+}
+
+func newFetcher(u *Upgrader, pkg *Package, name string) (Fetcher, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.fetchers[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`fetcher`, name)
+	}
+	return factory(u, pkg)
+}
+
+func newVerifier(u *Upgrader, pkg *Package, name string) (Verifier, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.verifiers[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`verifier`, name)
+	}
+	return factory(u, pkg)
+}
+
+func newExtractor(u *Upgrader, pkg *Package, name string) (Extractor, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.extractors[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`extractor`, name)
+	}
+	return factory(u, pkg)
+}
+
+func newInstaller(u *Upgrader, pkg *Package, name string) (Installer, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.installers[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`installer`, name)
+	}
+	return factory(u, pkg)
+}
+
+// NewNotifier creates the notifier selected by config.Type.
+func (u *Upgrader) NewNotifier(config StageConfig) (Notifier, error) {
+	registry.mutex.RLock()
+	var factory, ok = registry.notifiers[config.Type]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, unknownType(`notifier`, config.Type)
+	}
+	return factory(u, config)
+}
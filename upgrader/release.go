@@ -0,0 +1,130 @@
+package upgrader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+// Release is a version offered by a VersionSource. Version, Rollout and
+// Sha256 are also the fields of the JSON version manifest.
+type Release struct {
+	Version string   `json:"version"`
+	Rollout *float64 `json:"rollout,omitempty"`
+	Sha256  string   `json:"sha256,omitempty"`
+	Patches []Patch  `json:"patches,omitempty"`
+	// Files, when set, lists every file of the release so that only the
+	// changed ones are fetched from the blob store.
+	Files []FileEntry `json:"files,omitempty"`
+
+	Artifacts []Artifact `json:"-"`
+}
+
+// Patch turns the full package of version From into the package of the
+// release.
+type Patch struct {
+	From   string `json:"from"`
+	Uri    string `json:"uri"`
+	Sha256 string `json:"sha256,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// Artifact is one file of a release. Uris are mirrors of the same file,
+// Filename overrides the name taken from the first URI, and Checksum or the
+// content at ChecksumUri verifies the download.
+type Artifact struct {
+	Uris        UriList
+	Filename    string
+	Checksum    string
+	ChecksumUri string
+}
+
+// ParseVersionManifest accepts a plain version number or a JSON manifest.
+func ParseVersionManifest(content string) (release Release, err error) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, `{`) {
+		if err = json.Unmarshal([]byte(content), &release); err != nil {
+			return
+		}
+		release.Version = strings.TrimSpace(release.Version)
+	} else {
+		release.Version = content
+	}
+	if release.Version == `` {
+		err = errors.New(`version manifest is empty`)
+	}
+	return
+}
+
+// RequestVersionManifest fetches and parses the version manifest at uri with
+// the client of pkg, sending the validators of the previous response so that
+// an unchanged manifest is not transferred again.
+func (u *Upgrader) RequestVersionManifest(ctx context.Context, pkg *Package, uri string) (release Release, err error) {
+	var cached = u.state.versionCache(pkg.Name, uri)
+	var content string
+	var modified bool
+	var validators utils.Validators
+	if content, modified, validators, err = pkg.client.RequestTextIfModified(ctx, uri, cached.Validators); err != nil {
+		return
+	}
+	if !modified {
+		content = cached.Body
+	} else {
+		u.state.Update(pkg.Name, func(state *PackageState) {
+			if state.VersionCache == nil {
+				state.VersionCache = make(map[string]versionCacheEntry)
+			}
+			if validators.ETag != `` || validators.LastModified != `` {
+				state.VersionCache[uri] = versionCacheEntry{Validators: validators, Body: content}
+			} else {
+				delete(state.VersionCache, uri)
+			}
+		})
+	}
+	release, err = ParseVersionManifest(content)
+	return
+}
+
+func (r Release) RolloutPercent() float64 {
+	if r.Rollout == nil {
+		return 100
+	}
+	return *r.Rollout
+}
+
+func (u *Upgrader) rolledOut(name string, release Release) bool {
+	var percent = release.RolloutPercent()
+	if inRolloutCohort(u.machineID, name, percent) {
+		return true
+	}
+	u.log(logging.Info, fmt.Sprintf(`not rolled out to this host yet: %g%%`, percent), logging.Fields{Package: name, Version: release.Version, Phase: phaseCheck})
+	return false
+}
+
+func inRolloutCohort(machineID, name string, percent float64) bool {
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 {
+		return false
+	}
+	var sum = sha256.Sum256([]byte(machineID + `/` + name))
+	var bucket = binary.BigEndian.Uint64(sum[:8]) % 10000
+	return float64(bucket) < percent*100
+}
+
+func randomJitter(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
@@ -0,0 +1,69 @@
+package upgrader
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInRolloutCohort(t *testing.T) {
+	var tests = []struct {
+		percent float64
+		want    bool
+	}{
+		{-5, false},
+		{0, false},
+		{100, true},
+		{150, true},
+	}
+	for _, test := range tests {
+		if got := inRolloutCohort(`machine`, `app`, test.percent); got != test.want {
+			t.Errorf(`inRolloutCohort at %g%% = %t, want %t`, test.percent, got, test.want)
+		}
+	}
+}
+
+func TestInRolloutCohortStable(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var machineID = fmt.Sprintf(`machine-%d`, i)
+		var joined = false
+		for percent := 0.0; percent <= 100; percent += 0.5 {
+			var in = inRolloutCohort(machineID, `app`, percent)
+			if in != inRolloutCohort(machineID, `app`, percent) {
+				t.Fatalf(`%s at %g%%: not deterministic`, machineID, percent)
+			}
+			if joined && !in {
+				t.Fatalf(`%s left the rollout when it grew to %g%%`, machineID, percent)
+			}
+			joined = in
+		}
+	}
+}
+
+func TestInRolloutCohortShare(t *testing.T) {
+	const hosts = 10000
+	for _, percent := range []float64{1, 10, 25, 50, 90} {
+		var in = 0
+		for i := 0; i < hosts; i++ {
+			if inRolloutCohort(fmt.Sprintf(`machine-%d`, i), `app`, percent) {
+				in++
+			}
+		}
+		var share = float64(in) * 100 / hosts
+		if share < percent*0.8-0.5 || share > percent*1.2+0.5 {
+			t.Errorf(`%g%% rollout reached %.2f%% of hosts`, percent, share)
+		}
+	}
+}
+
+func TestInRolloutCohortPerPackage(t *testing.T) {
+	var differ = 0
+	for i := 0; i < 1000; i++ {
+		var machineID = fmt.Sprintf(`machine-%d`, i)
+		if inRolloutCohort(machineID, `app`, 50) != inRolloutCohort(machineID, `other`, 50) {
+			differ++
+		}
+	}
+	if differ < 300 || differ > 700 {
+		t.Errorf(`cohorts of two packages differ on %d of 1000 hosts`, differ)
+	}
+}
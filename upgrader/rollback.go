@@ -0,0 +1,70 @@
+package upgrader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+// Rollback reinstalls the newest cached package older than the installed
+// version. The version it replaces is remembered in the state so that the
+// next check does not install it again; only a later release will be.
+func (u *Upgrader) Rollback(ctx context.Context, pkg *Package) (release Release, err error) {
+	var state, _ = u.state.Get(pkg.Name)
+	var current = state.LocalVersion
+	if current == `` {
+		err = fmt.Errorf(`installed version of %s is unknown`, pkg.Name)
+		return
+	}
+	var entries = u.cache.entries(pkg.Name)
+	for _, entry := range entries {
+		if comp, ok := version.CompareVersion(entry.Version, current); !ok || comp >= 0 {
+			continue
+		}
+		if release.Version != `` {
+			if comp, _ := version.CompareVersion(entry.Version, release.Version); comp <= 0 {
+				continue
+			}
+		}
+		release.Version = entry.Version
+	}
+	if release.Version == `` {
+		err = fmt.Errorf(`no cached package of %s older than %s`, pkg.Name, current)
+		return
+	}
+	var dir string
+	if dir, err = ioutil.TempDir(os.TempDir(), `rollback`); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Version == release.Version {
+			if err = pkg.extractor.Extract(ctx, entry.File, dir); err != nil {
+				_ = os.RemoveAll(dir)
+				return
+			}
+		}
+	}
+	var staged bool
+	if staged, err = pkg.installer.Install(ctx, release, dir); err != nil || !staged {
+		_ = os.RemoveAll(dir)
+	}
+	if err != nil {
+		u.Notify(Event{Type: EventUpgradeFailed, Package: pkg.Name, Version: release.Version, Error: err.Error()})
+		return
+	}
+	u.state.Update(pkg.Name, func(state *PackageState) {
+		state.SkipVersion = current
+		if !staged {
+			state.LocalVersion = release.Version
+			state.LastUpgrade = time.Now()
+		}
+	})
+	u.log(logging.Info, `rolled back from `+current, logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseRollback})
+	u.Notify(Event{Type: EventRolledBack, Package: pkg.Name, Version: release.Version})
+	return
+}
@@ -0,0 +1,103 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	sourceDropFolder = `drop-folder`
+
+	dropFolderSettle = 10 * time.Second
+)
+
+func init() {
+	RegisterSource(sourceDropFolder, func(u *Upgrader, pkg *Package) (VersionSource, error) {
+		if pkg.DropFolder == `` {
+			return nil, errors.New(`dropFolder is required`)
+		}
+		return &dropFolderSource{u: u, pkg: pkg, dir: pkg.DropFolder}, nil
+	})
+}
+
+// dropFolderSource offers the archives found in dir. When next is set its
+// release is used unless the drop folder holds a higher version or next
+// fails.
+type dropFolderSource struct {
+	u    *Upgrader
+	pkg  *Package
+	dir  string
+	next VersionSource
+}
+
+func (s *dropFolderSource) Latest(ctx context.Context) (release Release, err error) {
+	if s.next != nil {
+		release, err = s.next.Latest(ctx)
+	}
+	var dropped, ok, unverified, e = scanDropFolder(s.dir, s.pkg.Name, s.pkg.AllowUnverified)
+	for _, filename := range unverified {
+		s.u.log(logging.Warning, `skipped `+filename+` in drop folder: no `+filename+`.sha256`, logging.Fields{Package: s.pkg.Name, Phase: phaseCheck})
+	}
+	if e != nil {
+		s.u.log(logging.Warning, `scan drop folder `+s.dir+` failed`, logging.Fields{Package: s.pkg.Name, Phase: phaseCheck, Error: e.Error()})
+		if s.next == nil {
+			err = e
+		}
+	} else if ok {
+		if comp, _ := version.CompareVersion(dropped.Version, release.Version); err != nil || release.Version == `` || comp > 0 {
+			release, err = dropped, nil
+		}
+	}
+	return
+}
+
+// scanDropFolder looks for archives named <name>-<version>.<ext> in dir and
+// returns the highest version as a release whose download URI is the local
+// file. A <file>.sha256 next to the archive provides its checksum; archives
+// without one are returned in unverified and skipped unless allowUnverified
+// is set. Files modified within the last few seconds are skipped since they
+// may still be copying.
+func scanDropFolder(dir, name string, allowUnverified bool) (release Release, ok bool, unverified []string, err error) {
+	var list []os.FileInfo
+	if list, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	var prefix = name + `-`
+	for _, item := range list {
+		var filename = item.Name()
+		var ext = archiveType(filename)
+		if item.IsDir() || ext == `` || !strings.HasPrefix(filename, prefix) || time.Since(item.ModTime()) < dropFolderSettle {
+			continue
+		}
+		var ver = filename[len(prefix) : len(filename)-len(ext)]
+		if _, valid := version.ParseVersion(ver); !valid {
+			continue
+		}
+		if ok {
+			if comp, _ := version.CompareVersion(ver, release.Version); comp <= 0 {
+				continue
+			}
+		}
+		var file = filepath.Join(dir, filename)
+		var artifact = Artifact{Uris: UriList{file}}
+		if content, found := utils.ReadTextFile(file + `.sha256`); found {
+			artifact.Checksum = parseChecksum(content, filename)
+		}
+		if artifact.Checksum == `` && !allowUnverified {
+			unverified = append(unverified, filename)
+			continue
+		}
+		release = Release{Version: ver, Artifacts: []Artifact{artifact}}
+		ok = true
+	}
+	return
+}
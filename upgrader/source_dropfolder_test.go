@@ -0,0 +1,87 @@
+package upgrader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func dropFile(t *testing.T, dir, filename, content string, age time.Duration) {
+	var file = filepath.Join(dir, filename)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var modified = time.Now().Add(-age)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanDropFolder(t *testing.T) {
+	const checksum = `e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`
+	var tests = []struct {
+		name            string
+		files           map[string]time.Duration
+		allowUnverified bool
+		version         string
+		unverified      []string
+	}{
+		{`highest version`, map[string]time.Duration{
+			`app-1.0.0.zip`: time.Hour, `app-1.0.0.zip.sha256`: time.Hour,
+			`app-1.10.0.tar.gz`: time.Hour, `app-1.10.0.tar.gz.sha256`: time.Hour,
+			`app-1.9.0.tgz`: time.Hour, `app-1.9.0.tgz.sha256`: time.Hour,
+		}, false, `1.10.0`, nil},
+		{`other packages and files ignored`, map[string]time.Duration{
+			`app-1.0.0.zip`: time.Hour, `app-1.0.0.zip.sha256`: time.Hour,
+			`other-2.0.0.zip`: time.Hour, `app-2.0.0.exe`: time.Hour, `app-latest.zip`: time.Hour,
+		}, false, `1.0.0`, nil},
+		{`still copying`, map[string]time.Duration{
+			`app-1.0.0.zip`: time.Hour, `app-1.0.0.zip.sha256`: time.Hour,
+			`app-2.0.0.zip`: time.Second, `app-2.0.0.zip.sha256`: time.Hour,
+		}, false, `1.0.0`, nil},
+		{`without checksum`, map[string]time.Duration{
+			`app-1.0.0.zip`: time.Hour, `app-1.0.0.zip.sha256`: time.Hour,
+			`app-2.0.0.zip`: time.Hour,
+		}, false, `1.0.0`, []string{`app-2.0.0.zip`}},
+		{`without checksum allowed`, map[string]time.Duration{
+			`app-1.0.0.zip`: time.Hour, `app-1.0.0.zip.sha256`: time.Hour,
+			`app-2.0.0.zip`: time.Hour,
+		}, true, `2.0.0`, nil},
+		{`nothing dropped`, map[string]time.Duration{`readme.txt`: time.Hour}, false, ``, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dir = t.TempDir()
+			for filename, age := range test.files {
+				var content = `archive`
+				if filepath.Ext(filename) == `.sha256` {
+					content = checksum + `  ` + filename[:len(filename)-len(`.sha256`)]
+				}
+				dropFile(t, dir, filename, content, age)
+			}
+			var release, ok, unverified, err = scanDropFolder(dir, `app`, test.allowUnverified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (test.version != ``) || release.Version != test.version {
+				t.Fatalf(`got version %q, %t, want %q`, release.Version, ok, test.version)
+			}
+			if !reflect.DeepEqual(unverified, test.unverified) {
+				t.Errorf(`unverified %v, want %v`, unverified, test.unverified)
+			}
+			if !ok {
+				return
+			}
+			var artifact = release.Artifacts[0]
+			if artifact.Uris.Primary() != filepath.Join(dir, `app-`+test.version+archiveType(artifact.Uris.Primary())) {
+				t.Errorf(`uri %s`, artifact.Uris.Primary())
+			}
+			if _, found := test.files[filepath.Base(artifact.Uris.Primary())+`.sha256`]; found && artifact.Checksum != checksum {
+				t.Errorf(`checksum %q, want %q`, artifact.Checksum, checksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	sourceGiteaReleases  = `gitea-releases`
+	sourceGithubReleases = `github-releases`
+
+	defaultReleasesApiUrl = `https://api.github.com`
+)
+
+var defaultChecksumAssets = []string{`SHA256SUMS`, `SHA256SUMS.txt`, `sha256sums.txt`, `checksums.txt`}
+
+type GiteaReleasesConfig struct {
+	ApiUrl          string `yaml:"apiUrl,omitempty"`
+	Owner           string `yaml:"owner"`
+	Repo            string `yaml:"repo"`
+	AssetPattern    string `yaml:"assetPattern"`
+	ChecksumPattern string `yaml:"checksumPattern,omitempty"`
+	PreRelease      bool   `yaml:"preRelease,omitempty"`
+}
+
+type giteaAsset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	BrowserDownloadUrl string `json:"browser_download_url"`
+}
+
+type giteaRelease struct {
+	TagName    string       `json:"tag_name"`
+	Draft      bool         `json:"draft"`
+	PreRelease bool         `json:"prerelease"`
+	Assets     []giteaAsset `json:"assets"`
+}
+
+func init() {
+	var factory = func(u *Upgrader, pkg *Package) (VersionSource, error) {
+		var config = pkg.Gitea
+		if config == nil {
+			config = &GiteaReleasesConfig{}
+			if err := pkg.Source.Decode(config); err != nil {
+				return nil, err
+			}
+		}
+		if !config.Validate() {
+			return nil, errors.New(`gitea owner, repo and assetPattern are required`)
+		}
+		return &giteaSource{u: u, pkg: pkg, config: config}, nil
+	}
+	RegisterSource(sourceGiteaReleases, factory)
+	RegisterSource(sourceGithubReleases, factory)
+}
+
+// giteaSource takes the latest release of a repository on Gitea or GitHub and
+// the asset matching assetPattern.
+type giteaSource struct {
+	u      *Upgrader
+	pkg    *Package
+	config *GiteaReleasesConfig
+}
+
+func (c *GiteaReleasesConfig) Validate() bool {
+	return c != nil && c.Owner != `` && c.Repo != `` && c.AssetPattern != ``
+}
+
+func (c *GiteaReleasesConfig) releasesUrl() string {
+	var apiUrl = c.ApiUrl
+	if apiUrl == `` {
+		apiUrl = defaultReleasesApiUrl
+	}
+	return fmt.Sprintf(`%s/repos/%s/%s/releases`, strings.TrimRight(apiUrl, `/`), url.PathEscape(c.Owner), url.PathEscape(c.Repo))
+}
+
+func (s *giteaSource) latest(ctx context.Context) (release giteaRelease, err error) {
+	var config = s.config
+	if !config.PreRelease {
+		_, err = s.pkg.client.RequestJson(ctx, config.releasesUrl()+`/latest`, `GET`, nil, &release)
+		return
+	}
+	var releases []giteaRelease
+	if _, err = s.pkg.client.RequestJson(ctx, config.releasesUrl()+`?limit=20&per_page=20`, `GET`, nil, &releases); err != nil {
+		return
+	}
+	var found bool
+	for _, item := range releases {
+		if item.Draft {
+			continue
+		}
+		if found {
+			if comp, ok := version.CompareVersion(releaseVersion(item.TagName), releaseVersion(release.TagName)); !ok || comp <= 0 {
+				continue
+			}
+		}
+		release, found = item, true
+	}
+	if !found {
+		err = errors.New(`no release found`)
+	}
+	return
+}
+
+func releaseVersion(tag string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(tag, `v`), `V`)
+}
+
+func (s *giteaSource) Latest(ctx context.Context) (manifest Release, err error) {
+	var config = s.config
+	var release giteaRelease
+	if release, err = s.latest(ctx); err != nil {
+		return
+	}
+	var asset, checksumAsset *giteaAsset
+	for i, item := range release.Assets {
+		if ok, _ := path.Match(config.AssetPattern, item.Name); ok && asset == nil {
+			asset = &release.Assets[i]
+		}
+	}
+	if asset == nil {
+		err = fmt.Errorf(`release %s has no asset matching %s`, release.TagName, config.AssetPattern)
+		return
+	}
+	for i, item := range release.Assets {
+		if item.Name == asset.Name+`.sha256` {
+			checksumAsset = &release.Assets[i]
+			break
+		}
+		if checksumAsset == nil && isChecksumAsset(config.ChecksumPattern, item.Name) {
+			checksumAsset = &release.Assets[i]
+		}
+	}
+	var artifact = Artifact{Uris: UriList{asset.BrowserDownloadUrl}, Filename: asset.Name}
+	if checksumAsset != nil {
+		artifact.ChecksumUri = checksumAsset.BrowserDownloadUrl
+	} else if !s.pkg.AllowUnverified {
+		err = fmt.Errorf(`release %s has no checksum asset for %s`, release.TagName, asset.Name)
+		return
+	}
+	manifest = Release{
+		Version:   releaseVersion(release.TagName),
+		Artifacts: []Artifact{artifact},
+	}
+	return
+}
+
+func isChecksumAsset(pattern, name string) bool {
+	if pattern != `` {
+		var ok, _ = path.Match(pattern, name)
+		return ok
+	}
+	for _, item := range defaultChecksumAssets {
+		if strings.EqualFold(item, name) {
+			return true
+		}
+	}
+	return false
+}
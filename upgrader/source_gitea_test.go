@@ -0,0 +1,321 @@
+package upgrader
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLogger discards what the pipeline logs.
+type testLogger struct{}
+
+func (testLogger) Error(v ...interface{}) error                   { return nil }
+func (testLogger) Warning(v ...interface{}) error                 { return nil }
+func (testLogger) Info(v ...interface{}) error                    { return nil }
+func (testLogger) Errorf(format string, a ...interface{}) error   { return nil }
+func (testLogger) Warningf(format string, a ...interface{}) error { return nil }
+func (testLogger) Infof(format string, a ...interface{}) error    { return nil }
+
+func newTestUpgrader(t *testing.T) *Upgrader {
+	var dir = t.TempDir()
+	return New(Options{Logger: testLogger{}, CacheDirectory: filepath.Join(dir, `cache`), UpgradeReadyFile: filepath.Join(dir, `upgrade.ready`)})
+}
+
+// newTestPackage returns a package installed at localVersion into a
+// temporary directory.
+func newTestPackage(t *testing.T, localVersion string) *Package {
+	return &Package{Name: `app`, WorkDirectory: t.TempDir(), LocalVersion: func(ctx context.Context) (string, error) {
+		return localVersion, nil
+	}}
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	var w = zip.NewWriter(&buffer)
+	for name, content := range files {
+		var f, err = w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func sha256Hex(content []byte) string {
+	var sum = sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// releasesServer stands in for the releases API of Gitea under /api/v1 and of
+// GitHub at the root, and serves the assets under /download/.
+type releasesServer struct {
+	*httptest.Server
+	releases []giteaRelease
+	files    map[string][]byte
+}
+
+func newReleasesServer(t *testing.T) *releasesServer {
+	var s = &releasesServer{files: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var path = strings.TrimPrefix(r.URL.Path, `/api/v1`)
+		switch {
+		case path == `/repos/team/app/releases/latest`:
+			for _, release := range s.releases {
+				if !release.Draft && !release.PreRelease {
+					_ = json.NewEncoder(w).Encode(release)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		case path == `/repos/team/app/releases`:
+			_ = json.NewEncoder(w).Encode(s.releases)
+		case strings.HasPrefix(r.URL.Path, `/download/`):
+			if content, ok := s.files[strings.TrimPrefix(r.URL.Path, `/download/`)]; ok {
+				_, _ = w.Write(content)
+				return
+			}
+			http.NotFound(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// release adds a release whose assets are served with the given content.
+func (s *releasesServer) release(tag string, draft, preRelease bool, assets map[string][]byte) {
+	var release = giteaRelease{TagName: tag, Draft: draft, PreRelease: preRelease}
+	for name, content := range assets {
+		var key = tag + `/` + name
+		s.files[key] = content
+		release.Assets = append(release.Assets, giteaAsset{Name: name, Size: int64(len(content)), BrowserDownloadUrl: s.URL + `/download/` + key})
+	}
+	s.releases = append(s.releases, release)
+}
+
+func TestGiteaReleasesLatest(t *testing.T) {
+	var archive = makeZip(t, map[string]string{`app.txt`: `1.2.0`})
+	var tests = []struct {
+		name       string
+		sourceType string
+		apiPath    string
+		config     GiteaReleasesConfig
+		setup      func(s *releasesServer)
+		version    string
+		checksum   string
+		err        string
+	}{
+		{`gitea with SHA256SUMS`, sourceGiteaReleases, `/api/v1`, GiteaReleasesConfig{AssetPattern: `app-*-x64.zip`}, func(s *releasesServer) {
+			s.release(`v1.2.0`, false, false, map[string][]byte{
+				`app-1.2.0-x64.zip`:   archive,
+				`app-1.2.0-arm64.zip`: []byte(`other`),
+				`SHA256SUMS`:          []byte(sha256Hex([]byte(`other`)) + "  app-1.2.0-arm64.zip\n" + sha256Hex(archive) + "  app-1.2.0-x64.zip\n"),
+			})
+		}, `1.2.0`, `SHA256SUMS`, ``},
+		{`github with <asset>.sha256`, sourceGithubReleases, ``, GiteaReleasesConfig{AssetPattern: `app-*-x64.zip`}, func(s *releasesServer) {
+			s.release(`v1.2.0`, false, false, map[string][]byte{
+				`app-1.2.0-x64.zip`:        archive,
+				`app-1.2.0-x64.zip.sha256`: []byte(sha256Hex(archive)),
+				`checksums.txt`:            []byte(`0000`),
+			})
+		}, `1.2.0`, `app-1.2.0-x64.zip.sha256`, ``},
+		{`checksum pattern`, sourceGiteaReleases, `/api/v1`, GiteaReleasesConfig{AssetPattern: `app-*.zip`, ChecksumPattern: `*.sums`}, func(s *releasesServer) {
+			s.release(`1.2.0`, false, false, map[string][]byte{
+				`app-1.2.0.zip`: archive,
+				`release.sums`:  []byte(sha256Hex(archive) + ` *app-1.2.0.zip`),
+			})
+		}, `1.2.0`, `release.sums`, ``},
+		{`pre-releases`, sourceGiteaReleases, `/api/v1`, GiteaReleasesConfig{AssetPattern: `app-*.zip`, PreRelease: true}, func(s *releasesServer) {
+			s.release(`v1.1.0`, false, false, map[string][]byte{`app-1.1.0.zip`: archive})
+			s.release(`v2.0.0`, true, false, map[string][]byte{`app-2.0.0.zip`: archive})
+			s.release(`v1.3.0`, false, true, map[string][]byte{`app-1.3.0.zip`: archive, `SHA256SUMS`: []byte(sha256Hex(archive) + `  app-1.3.0.zip`)})
+		}, `1.3.0`, `SHA256SUMS`, ``},
+		{`no matching asset`, sourceGiteaReleases, `/api/v1`, GiteaReleasesConfig{AssetPattern: `app-*-x64.zip`}, func(s *releasesServer) {
+			s.release(`v1.2.0`, false, false, map[string][]byte{`app-1.2.0-arm64.zip`: archive})
+		}, ``, ``, `no asset matching`},
+		{`no release`, sourceGiteaReleases, `/api/v1`, GiteaReleasesConfig{AssetPattern: `app-*.zip`}, func(s *releasesServer) {
+		}, ``, ``, `404`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s = newReleasesServer(t)
+			test.setup(s)
+			var u = newTestUpgrader(t)
+			var pkg = newTestPackage(t, `1.0.0`)
+			var config = test.config
+			config.ApiUrl, config.Owner, config.Repo = s.URL+test.apiPath, `team`, `app`
+			pkg.Gitea = &config
+			pkg.Source.Type = test.sourceType
+			if err := u.Prepare(pkg); err != nil {
+				t.Fatal(err)
+			}
+			var release, needed, err = u.Check(context.Background(), pkg)
+			if test.err != `` {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf(`got error %v, want %s`, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !needed || release.Version != test.version {
+				t.Fatalf(`got %s, needed %t, want %s`, release.Version, needed, test.version)
+			}
+			var artifact = release.Artifacts[0]
+			if test.checksum == `` {
+				if artifact.ChecksumUri != `` {
+					t.Errorf(`checksum uri %q, want none`, artifact.ChecksumUri)
+				}
+				return
+			}
+			if !strings.HasSuffix(artifact.ChecksumUri, `/`+test.checksum) {
+				t.Errorf(`checksum uri %q, want the %s asset`, artifact.ChecksumUri, test.checksum)
+			}
+			var dir string
+			if dir, err = u.Download(context.Background(), pkg, release); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+			if content, _ := ioutil.ReadFile(filepath.Join(dir, `app.txt`)); string(content) != `1.2.0` {
+				t.Errorf(`extracted app.txt holds %q`, content)
+			}
+		})
+	}
+}
+
+func TestGiteaReleasesChecksumMismatch(t *testing.T) {
+	var s = newReleasesServer(t)
+	s.release(`v1.2.0`, false, false, map[string][]byte{
+		`app-1.2.0.zip`: makeZip(t, map[string]string{`app.txt`: `1.2.0`}),
+		`SHA256SUMS`:    []byte(sha256Hex([]byte(`something else`)) + `  app-1.2.0.zip`),
+	})
+	var u = newTestUpgrader(t)
+	var pkg = newTestPackage(t, `1.0.0`)
+	pkg.Gitea = &GiteaReleasesConfig{ApiUrl: s.URL + `/api/v1`, Owner: `team`, Repo: `app`, AssetPattern: `app-*.zip`}
+	pkg.Source.Type = sourceGiteaReleases
+	if err := u.Prepare(pkg); err != nil {
+		t.Fatal(err)
+	}
+	var release, _, err = u.Check(context.Background(), pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Download(context.Background(), pkg, release); err == nil || !strings.Contains(err.Error(), `checksum mismatch`) {
+		t.Fatalf(`got error %v, want a checksum mismatch`, err)
+	}
+}
+
+func TestGiteaReleasesAssetNameTraversal(t *testing.T) {
+	var s = newReleasesServer(t)
+	var archive = makeZip(t, map[string]string{`app.txt`: `1.2.0`})
+	s.release(`v1.2.0`, false, false, map[string][]byte{`..\app-1.2.0.zip`: archive})
+	var u = newTestUpgrader(t)
+	var pkg = newTestPackage(t, `1.0.0`)
+	pkg.Gitea = &GiteaReleasesConfig{ApiUrl: s.URL, Owner: `team`, Repo: `app`, AssetPattern: `*.zip`}
+	pkg.Source.Type, pkg.AllowUnverified = sourceGithubReleases, true
+	if err := u.Prepare(pkg); err != nil {
+		t.Fatal(err)
+	}
+	var release, _, err = u.Check(context.Background(), pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release.Artifacts[0].Checksum = sha256Hex(archive)
+	if _, err = u.Download(context.Background(), pkg, release); err == nil || !strings.Contains(err.Error(), `invalid artifact file name`) {
+		t.Fatalf(`got error %v, want an invalid file name`, err)
+	}
+}
+
+func TestGiteaReleasesUnverified(t *testing.T) {
+	var s = newReleasesServer(t)
+	s.release(`v1.2.0`, false, false, map[string][]byte{`app-1.2.0.zip`: makeZip(t, map[string]string{`app.txt`: `1.2.0`})})
+	for _, allow := range []bool{false, true} {
+		var u = newTestUpgrader(t)
+		var pkg = newTestPackage(t, `1.0.0`)
+		pkg.Gitea = &GiteaReleasesConfig{ApiUrl: s.URL + `/api/v1`, Owner: `team`, Repo: `app`, AssetPattern: `app-*.zip`}
+		pkg.Source.Type, pkg.AllowUnverified = sourceGiteaReleases, allow
+		if err := u.Prepare(pkg); err != nil {
+			t.Fatal(err)
+		}
+		var release, needed, err = u.Check(context.Background(), pkg)
+		if !allow {
+			if err == nil || !strings.Contains(err.Error(), `no checksum asset`) {
+				t.Errorf(`got error %v, want a missing checksum asset`, err)
+			}
+			continue
+		}
+		if err != nil || !needed || release.Artifacts[0].ChecksumUri != `` {
+			t.Errorf(`with allowUnverified got %+v, needed %t, error %v`, release, needed, err)
+		}
+	}
+}
+
+func TestArtifactName(t *testing.T) {
+	var tests = []struct {
+		artifact Artifact
+		want     string
+	}{
+		{Artifact{Uris: UriList{`https://example.com/releases/app-1.2.0.zip?token=x`}}, `app-1.2.0.zip`},
+		{Artifact{Uris: UriList{`https://example.com/download`}, Filename: `app-1.2.0.zip`}, `app-1.2.0.zip`},
+		{Artifact{Uris: UriList{`https://example.com/`}}, ``},
+		{Artifact{Uris: UriList{`https://example.com/x`}, Filename: `../app.zip`}, ``},
+		{Artifact{Uris: UriList{`https://example.com/x`}, Filename: `..`}, ``},
+		{Artifact{Uris: UriList{`https://example.com/x`}, Filename: `dir/app.zip`}, ``},
+		{Artifact{Uris: UriList{`https://example.com/x`}, Filename: `dir\app.zip`}, ``},
+		{Artifact{Uris: UriList{`https://example.com/x`}, Filename: `/etc/passwd`}, ``},
+	}
+	for _, test := range tests {
+		var got, err = test.artifact.name()
+		if test.want == `` {
+			if err == nil {
+				t.Errorf(`name() of %+v = %q, want an error`, test.artifact, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf(`name() of %+v = %q, %v, want %q`, test.artifact, got, err, test.want)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	const sum = `e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`
+	var tests = []struct {
+		name     string
+		content  string
+		filename string
+		want     string
+	}{
+		{`bare checksum`, sum, `app.zip`, sum},
+		{`bare checksum with newline`, sum + "\n", `app.zip`, sum},
+		{`sha256sum output`, sum + `  app.zip`, `app.zip`, sum},
+		{`binary mode`, sum + ` *app.zip`, `app.zip`, sum},
+		{`several files`, "1111  other.zip\n" + sum + "  app.zip\n2222  more.zip\n", `app.zip`, sum},
+		{`CRLF`, "1111  other.zip\r\n" + sum + "  app.zip\r\n", `app.zip`, sum},
+		{`file not listed`, "1111  other.zip\n2222  more.zip\n", `app.zip`, `1111`},
+		{`empty`, "\n\n", `app.zip`, ``},
+	}
+	for _, test := range tests {
+		if got := parseChecksum(test.content, test.filename); got != test.want {
+			t.Errorf(`%s: got %q, want %q`, test.name, got, test.want)
+		}
+	}
+}
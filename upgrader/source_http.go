@@ -0,0 +1,40 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+)
+
+const sourceHttp = `http`
+
+func init() {
+	RegisterSource(sourceHttp, func(u *Upgrader, pkg *Package) (VersionSource, error) {
+		if len(pkg.UriCheckVersion) == 0 || len(pkg.UriDownloadPackage) == 0 && len(pkg.UriBlobs) == 0 {
+			return nil, errors.New(`uriCheckVersion and uriDownloadPackage or uriBlobs are required`)
+		}
+		return &httpSource{u: u, pkg: pkg}, nil
+	})
+}
+
+// httpSource reads the version manifest from uriCheckVersion and downloads
+// uriDownloadPackage, or the files listed in the manifest from uriBlobs, all
+// of which may be mirror lists.
+type httpSource struct {
+	u   *Upgrader
+	pkg *Package
+}
+
+func (s *httpSource) Latest(ctx context.Context) (release Release, err error) {
+	err = s.u.mirrors.try(s.pkg.UriCheckVersion, s.pkg.MirrorStrategy, func(uri string) (err error) {
+		release, err = s.u.RequestVersionManifest(ctx, s.pkg, uri)
+		return
+	})
+	if len(s.pkg.UriDownloadPackage) > 0 {
+		release.Artifacts = []Artifact{{
+			Uris:        s.pkg.UriDownloadPackage,
+			Checksum:    release.Sha256,
+			ChecksumUri: s.pkg.UriChecksum,
+		}}
+	}
+	return
+}
@@ -0,0 +1,314 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	sourceOci = `oci`
+
+	ociTitleAnnotation   = `org.opencontainers.image.title`
+	ociVersionAnnotation = `org.opencontainers.image.version`
+
+	// defaultOciTokenLifetime applies to tokens issued without expires_in,
+	// as the token specification says.
+	defaultOciTokenLifetime = 60 * time.Second
+	ociTokenMargin          = 10 * time.Second
+	ociMaxTagPages          = 100
+)
+
+var ociManifestTypes = strings.Join([]string{
+	`application/vnd.oci.image.manifest.v1+json`,
+	`application/vnd.oci.image.index.v1+json`,
+	`application/vnd.docker.distribution.manifest.v2+json`,
+	`application/vnd.docker.distribution.manifest.list.v2+json`,
+}, `, `)
+
+var reChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+var reOciDigest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+type OciConfig struct {
+	Registry   string `yaml:"registry"`
+	Repository string `yaml:"repository"`
+	Tag        string `yaml:"tag,omitempty"`
+	Username   string `yaml:"username,omitempty"`
+	Password   string `yaml:"password,omitempty"`
+
+	client  *utils.HttpClient
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+	basic   bool
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Manifests   []ociDescriptor   `json:"manifests,omitempty"`
+	Layers      []ociDescriptor   `json:"layers,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociTags struct {
+	Tags []string `json:"tags"`
+}
+
+func init() {
+	RegisterSource(sourceOci, func(u *Upgrader, pkg *Package) (VersionSource, error) {
+		var config = pkg.Oci
+		if config == nil {
+			config = &OciConfig{}
+			if err := pkg.Source.Decode(config); err != nil {
+				return nil, err
+			}
+		}
+		if !config.Validate() {
+			return nil, errors.New(`oci registry and repository are required`)
+		}
+		config.client = pkg.client
+		pkg.client = pkg.client.WithSigner(config.sign).WithReauthorizer(config.authorize)
+		return &ociSource{u: u, pkg: pkg, config: config}, nil
+	})
+}
+
+// ociSource resolves a tag of an OCI registry repository to the layers of its
+// manifest.
+type ociSource struct {
+	u      *Upgrader
+	pkg    *Package
+	config *OciConfig
+}
+
+func (c *OciConfig) Validate() bool {
+	return c != nil && c.Registry != `` && c.Repository != ``
+}
+
+func (c *OciConfig) url(kind, reference string) string {
+	var registry = strings.TrimRight(c.Registry, `/`)
+	if !strings.Contains(registry, `://`) {
+		registry = `https://` + registry
+	}
+	return fmt.Sprintf(`%s/v2/%s/%s/%s`, registry, c.Repository, kind, reference)
+}
+
+func (c *OciConfig) credentials() (username, password string, err error) {
+	if username, err = utils.ResolveSecret(c.Username); err == nil {
+		password, err = utils.ResolveSecret(c.Password)
+	}
+	return
+}
+
+func (c *OciConfig) sign(req *http.Request) (err error) {
+	if strings.Contains(req.URL.Path, `/manifests/`) {
+		req.Header.Set(`Accept`, ociManifestTypes)
+	}
+	c.mutex.Lock()
+	var token, basic = c.token, c.basic
+	if time.Now().After(c.expires) {
+		// An expired token is left out; the registry answers with a new
+		// challenge and the client reauthorizes.
+		token = ``
+	}
+	c.mutex.Unlock()
+	if token != `` {
+		req.Header.Set(`Authorization`, `Bearer `+token)
+	} else if basic {
+		var username, password string
+		if username, password, err = c.credentials(); err == nil {
+			req.SetBasicAuth(username, password)
+		}
+	}
+	return
+}
+
+// authorize answers a 401 challenge: Basic makes further requests send the
+// configured credentials, Bearer fetches a token from the realm named in the
+// challenge as in the Docker registry token flow.
+func (c *OciConfig) authorize(ctx context.Context, challenge string) (err error) {
+	var scheme = strings.ToLower(strings.SplitN(challenge, ` `, 2)[0])
+	if scheme == `basic` {
+		c.mutex.Lock()
+		c.basic = true
+		c.mutex.Unlock()
+		return
+	}
+	if scheme != `bearer` {
+		return fmt.Errorf(`unsupported registry authentication: %s`, challenge)
+	}
+	var params = make(map[string]string)
+	for _, match := range reChallengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	if params[`realm`] == `` {
+		return errors.New(`registry token challenge without realm`)
+	}
+	var tokenUrl *url.URL
+	if tokenUrl, err = url.Parse(params[`realm`]); err != nil {
+		return
+	}
+	var query = tokenUrl.Query()
+	for _, name := range []string{`service`, `scope`} {
+		if params[name] != `` {
+			query.Set(name, params[name])
+		}
+	}
+	tokenUrl.RawQuery = query.Encode()
+	var client = c.client
+	if c.Username != `` {
+		var username, password string
+		if username, password, err = c.credentials(); err != nil {
+			return
+		}
+		client = client.WithAuth(utils.HttpAuth{BasicAuth: &utils.BasicAuth{Username: username, Password: password}})
+	}
+	var reply struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if _, err = client.RequestJson(ctx, tokenUrl.String(), `GET`, nil, &reply); err != nil {
+		return
+	}
+	var lifetime = defaultOciTokenLifetime
+	if reply.ExpiresIn > 0 {
+		lifetime = time.Duration(reply.ExpiresIn) * time.Second
+	}
+	c.mutex.Lock()
+	if c.token = reply.Token; c.token == `` {
+		c.token = reply.AccessToken
+	}
+	c.expires = time.Now().Add(lifetime - ociTokenMargin)
+	c.mutex.Unlock()
+	return
+}
+
+// requestJson fetches a registry document; the package client answers
+// authentication challenges, including one for an expired token.
+func (s *ociSource) requestJson(ctx context.Context, uri string, reply interface{}) (err error) {
+	_, err = s.pkg.client.RequestJson(ctx, uri, `GET`, nil, reply)
+	return
+}
+
+// latestTag returns the highest version tag, following the Link header
+// through the pages of the tag list.
+func (s *ociSource) latestTag(ctx context.Context) (tag string, err error) {
+	var uri = s.config.url(`tags`, `list?n=1000`)
+	for page := 0; uri != ``; page++ {
+		if page == ociMaxTagPages {
+			err = fmt.Errorf(`%s has more than %d pages of tags`, s.config.Repository, ociMaxTagPages)
+			return
+		}
+		var tags ociTags
+		if uri, err = s.pkg.client.RequestJsonPage(ctx, uri, &tags); err != nil {
+			return
+		}
+		for _, item := range tags.Tags {
+			if _, ok := version.ParseVersion(releaseVersion(item)); !ok {
+				continue
+			}
+			if tag != `` {
+				if comp, _ := version.CompareVersion(releaseVersion(item), releaseVersion(tag)); comp <= 0 {
+					continue
+				}
+			}
+			tag = item
+		}
+	}
+	if tag == `` {
+		err = fmt.Errorf(`no version tag found in %s`, s.config.Repository)
+	}
+	return
+}
+
+func (s *ociSource) Latest(ctx context.Context) (manifest Release, err error) {
+	var config = s.config
+	var tag = config.Tag
+	if tag == `` {
+		if tag, err = s.latestTag(ctx); err != nil {
+			return
+		}
+	}
+	var image ociManifest
+	if err = s.requestJson(ctx, config.url(`manifests`, tag), &image); err != nil {
+		return
+	}
+	if len(image.Manifests) > 0 {
+		var selected = image.Manifests[0]
+		for _, item := range image.Manifests {
+			if item.Platform != nil && item.Platform.OS == runtime.GOOS && item.Platform.Architecture == runtime.GOARCH {
+				selected = item
+				break
+			}
+		}
+		if !reOciDigest.MatchString(selected.Digest) {
+			err = fmt.Errorf(`unsupported manifest digest: %s`, selected.Digest)
+			return
+		}
+		if err = s.requestJson(ctx, config.url(`manifests`, selected.Digest), &image); err != nil {
+			return
+		}
+	}
+	if len(image.Layers) == 0 {
+		err = fmt.Errorf(`%s:%s has no layers`, config.Repository, tag)
+		return
+	}
+	if manifest.Version = image.Annotations[ociVersionAnnotation]; manifest.Version == `` {
+		manifest.Version = releaseVersion(tag)
+	}
+	if _, ok := version.ParseVersion(manifest.Version); !ok {
+		err = fmt.Errorf(`%s:%s does not carry a version`, config.Repository, tag)
+		return
+	}
+	for _, layer := range image.Layers {
+		if !reOciDigest.MatchString(layer.Digest) {
+			err = fmt.Errorf(`unsupported layer digest: %s`, layer.Digest)
+			return
+		}
+		var parts = strings.SplitN(layer.Digest, `:`, 2)
+		var filename = layer.Annotations[ociTitleAnnotation]
+		if filename == `` || archiveType(filename) == `` {
+			filename = parts[1][:12] + ociLayerExtension(layer.MediaType)
+		}
+		manifest.Artifacts = append(manifest.Artifacts, Artifact{
+			Uris:     UriList{config.url(`blobs`, layer.Digest)},
+			Filename: filename,
+			Checksum: parts[1],
+		})
+	}
+	return
+}
+
+func ociLayerExtension(mediaType string) string {
+	switch {
+	case strings.Contains(mediaType, `zip`):
+		return `.zip`
+	case strings.HasSuffix(mediaType, `.tar`) || strings.HasSuffix(mediaType, `tar`):
+		return `.tar`
+	default:
+		return `.tar.gz`
+	}
+}
@@ -0,0 +1,210 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// registryServer stands in for an OCI registry that hands out bearer tokens
+// from /token to the user app with the password secret. It lists at most
+// ociTestPageSize tags per page.
+type registryServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	tags      []string
+	manifests map[string]interface{}
+	blobs     map[string][]byte
+	token     string
+	issued    int
+}
+
+const ociTestPageSize = 2
+
+func newRegistryServer(t *testing.T) *registryServer {
+	var s = &registryServer{manifests: make(map[string]interface{}), blobs: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if r.URL.Path == `/token` {
+			if username, password, ok := r.BasicAuth(); !ok || username != `app` || password != `secret` {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get(`scope`) != `repository:team/app:pull` || r.URL.Query().Get(`service`) != `registry` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.issued++
+			s.token = fmt.Sprintf(`token-%d`, s.issued)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{`token`: s.token, `expires_in`: 300})
+			return
+		}
+		if s.token == `` || r.Header.Get(`Authorization`) != `Bearer `+s.token {
+			w.Header().Set(`WWW-Authenticate`, fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:team/app:pull"`, s.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var path = strings.TrimPrefix(r.URL.Path, `/v2/team/app/`)
+		switch {
+		case path == `tags/list`:
+			var tags = s.tags
+			for i, tag := range tags {
+				if tag == r.URL.Query().Get(`last`) {
+					tags = tags[i+1:]
+					break
+				}
+			}
+			if len(tags) > ociTestPageSize {
+				tags = tags[:ociTestPageSize]
+				w.Header().Set(`Link`, fmt.Sprintf(`</v2/team/app/tags/list?n=%d&last=%s>; rel="next"`, ociTestPageSize, tags[len(tags)-1]))
+			}
+			_ = json.NewEncoder(w).Encode(ociTags{Tags: tags})
+		case strings.HasPrefix(path, `manifests/`):
+			if manifest, ok := s.manifests[strings.TrimPrefix(path, `manifests/`)]; ok {
+				_ = json.NewEncoder(w).Encode(manifest)
+				return
+			}
+			http.NotFound(w, r)
+		case strings.HasPrefix(path, `blobs/`):
+			if content, ok := s.blobs[strings.TrimPrefix(path, `blobs/`)]; ok {
+				_, _ = w.Write(content)
+				return
+			}
+			http.NotFound(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// layer stores content as a blob and returns its descriptor.
+func (s *registryServer) layer(title string, content []byte) ociDescriptor {
+	var digest = `sha256:` + sha256Hex(content)
+	s.blobs[digest] = content
+	return ociDescriptor{MediaType: `application/zip`, Digest: digest, Size: int64(len(content)), Annotations: map[string]string{ociTitleAnnotation: title}}
+}
+
+// revoke invalidates the issued token, as when it expires at the registry
+// before the local expiry.
+func (s *registryServer) revoke() {
+	s.mutex.Lock()
+	s.token = `revoked`
+	s.mutex.Unlock()
+}
+
+func newOciPackage(t *testing.T, u *Upgrader, s *registryServer, tag string) *Package {
+	t.Setenv(`DAEMONUPGRADER_TEST_OCI_PASSWORD`, `secret`)
+	var pkg = newTestPackage(t, `1.0.0`)
+	pkg.Oci = &OciConfig{Registry: s.URL, Repository: `team/app`, Tag: tag, Username: `app`, Password: `env:DAEMONUPGRADER_TEST_OCI_PASSWORD`}
+	pkg.Source.Type = sourceOci
+	if err := u.Prepare(pkg); err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestOciLatest(t *testing.T) {
+	var s = newRegistryServer(t)
+	var archive = makeZip(t, map[string]string{`app.txt`: `1.2.0`})
+	// The newest version is on the last page of tags.
+	s.tags = []string{`latest`, `v1.0.0`, `v1.1.0`, `main`, `v1.2.0`}
+	var other = `sha256:` + strings.Repeat(`1`, 64)
+	var image = `sha256:` + strings.Repeat(`2`, 64)
+	s.manifests[other] = ociManifest{Layers: []ociDescriptor{s.layer(`other.zip`, []byte(`other`))}}
+	s.manifests[image] = ociManifest{Layers: []ociDescriptor{s.layer(`app-1.2.0.zip`, archive)}}
+	s.manifests[`v1.2.0`] = ociManifest{Manifests: []ociDescriptor{
+		{Digest: other, Platform: &ociPlatform{OS: `plan9`, Architecture: `mips`}},
+		{Digest: image, Platform: &ociPlatform{OS: runtime.GOOS, Architecture: runtime.GOARCH}},
+	}}
+	var u = newTestUpgrader(t)
+	var pkg = newOciPackage(t, u, s, ``)
+	var release, needed, err = u.Check(context.Background(), pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !needed || release.Version != `1.2.0` {
+		t.Fatalf(`got %s, needed %t, want 1.2.0`, release.Version, needed)
+	}
+	if len(release.Artifacts) != 1 || release.Artifacts[0].Filename != `app-1.2.0.zip` || release.Artifacts[0].Checksum != sha256Hex(archive) {
+		t.Fatalf(`got artifacts %+v, want the layer of the %s/%s manifest`, release.Artifacts, runtime.GOOS, runtime.GOARCH)
+	}
+	s.revoke()
+	var dir string
+	if dir, err = u.Download(context.Background(), pkg, release); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, `app.txt`)); string(content) != `1.2.0` {
+		t.Errorf(`extracted app.txt holds %q`, content)
+	}
+	if s.issued != 2 {
+		t.Errorf(`registry issued %d tokens, want a second one after the first was revoked`, s.issued)
+	}
+}
+
+func TestOciLatestErrors(t *testing.T) {
+	var tests = []struct {
+		name  string
+		tag   string
+		setup func(s *registryServer)
+		err   string
+	}{
+		{`no version tag`, ``, func(s *registryServer) {
+			s.tags = []string{`latest`, `main`}
+		}, `no version tag found`},
+		{`no layers`, `v1.2.0`, func(s *registryServer) {
+			s.manifests[`v1.2.0`] = ociManifest{}
+		}, `has no layers`},
+		{`no version`, `latest`, func(s *registryServer) {
+			s.manifests[`latest`] = ociManifest{Layers: []ociDescriptor{s.layer(`app.zip`, []byte(`app`))}}
+		}, `does not carry a version`},
+		{`index digest`, `v1.2.0`, func(s *registryServer) {
+			s.manifests[`v1.2.0`] = ociManifest{Manifests: []ociDescriptor{{Digest: `../../tags/list`}}}
+		}, `unsupported manifest digest`},
+		{`short digest`, `v1.2.0`, func(s *registryServer) {
+			s.manifests[`v1.2.0`] = ociManifest{Layers: []ociDescriptor{{Digest: `sha256:abcd`}}}
+		}, `unsupported layer digest`},
+		{`other algorithm`, `v1.2.0`, func(s *registryServer) {
+			s.manifests[`v1.2.0`] = ociManifest{Layers: []ociDescriptor{{Digest: `sha512:` + strings.Repeat(`0`, 128)}}}
+		}, `unsupported layer digest`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s = newRegistryServer(t)
+			test.setup(s)
+			var u = newTestUpgrader(t)
+			var pkg = newOciPackage(t, u, s, test.tag)
+			if _, _, err := u.Check(context.Background(), pkg); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf(`got error %v, want %s`, err, test.err)
+			}
+		})
+	}
+}
+
+func TestOciTitleTraversal(t *testing.T) {
+	var s = newRegistryServer(t)
+	s.manifests[`v1.2.0`] = ociManifest{Layers: []ociDescriptor{s.layer(`../app-1.2.0.zip`, makeZip(t, map[string]string{`app.txt`: `1.2.0`}))}}
+	var u = newTestUpgrader(t)
+	var pkg = newOciPackage(t, u, s, `v1.2.0`)
+	var release, _, err = u.Check(context.Background(), pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Download(context.Background(), pkg, release); err == nil || !strings.Contains(err.Error(), `invalid artifact file name`) {
+		t.Fatalf(`got error %v, want an invalid file name`, err)
+	}
+}
@@ -0,0 +1,253 @@
+package upgrader
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+const (
+	sourceS3 = `s3`
+
+	defaultS3Region = `us-east-1`
+)
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region,omitempty"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix,omitempty"`
+	KeyPattern      string `yaml:"keyPattern"`
+	LatestKey       string `yaml:"latestKey,omitempty"`
+	AccessKeyId     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	SessionToken    string `yaml:"sessionToken,omitempty"`
+	VirtualHost     bool   `yaml:"virtualHost,omitempty"`
+	// VerifyETag takes the ETag of a single part upload as the MD5 of the
+	// object when there is no checksum. Objects encrypted with SSE-KMS or
+	// SSE-C have other ETags, so it is off by default.
+	VerifyETag bool `yaml:"verifyETag,omitempty"`
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+}
+
+func init() {
+	RegisterSource(sourceS3, func(u *Upgrader, pkg *Package) (VersionSource, error) {
+		var config = pkg.S3
+		if config == nil {
+			config = &S3Config{}
+			if err := pkg.Source.Decode(config); err != nil {
+				return nil, err
+			}
+		}
+		if !config.Validate() {
+			return nil, errors.New(`s3 endpoint, bucket and a keyPattern containing {version} are required`)
+		}
+		pkg.client = pkg.client.WithSigner(config.sign)
+		return &s3Source{u: u, pkg: pkg, config: config}, nil
+	})
+}
+
+// s3Source finds releases in an S3 compatible bucket, either through a
+// latest object or by listing the keys matching keyPattern.
+type s3Source struct {
+	u      *Upgrader
+	pkg    *Package
+	config *S3Config
+}
+
+func (c *S3Config) Validate() bool {
+	return c != nil && c.Endpoint != `` && c.Bucket != `` && strings.Contains(c.KeyPattern, `{version}`)
+}
+
+func (c *S3Config) region() string {
+	if c.Region == `` {
+		return defaultS3Region
+	}
+	return c.Region
+}
+
+func (c *S3Config) credentials() (credentials utils.SigV4Credentials, err error) {
+	var accessKeyId, secretAccessKey = c.AccessKeyId, c.SecretAccessKey
+	if accessKeyId == `` {
+		accessKeyId = os.Getenv(`AWS_ACCESS_KEY_ID`)
+	}
+	if secretAccessKey == `` {
+		secretAccessKey = os.Getenv(`AWS_SECRET_ACCESS_KEY`)
+	}
+	if credentials.AccessKeyId, err = utils.ResolveSecret(accessKeyId); err != nil {
+		return
+	}
+	if credentials.SecretAccessKey, err = utils.ResolveSecret(secretAccessKey); err != nil {
+		return
+	}
+	credentials.SessionToken, err = utils.ResolveSecret(c.SessionToken)
+	return
+}
+
+func (c *S3Config) sign(req *http.Request) (err error) {
+	var credentials utils.SigV4Credentials
+	if credentials, err = c.credentials(); err == nil && credentials.AccessKeyId != `` {
+		utils.SignV4(req, credentials, c.region(), `s3`, time.Now())
+	}
+	return
+}
+
+func (c *S3Config) objectUrl(key string, query url.Values) (string, error) {
+	var u, err = url.Parse(c.Endpoint)
+	if err != nil {
+		return ``, err
+	}
+	var objectPath = `/` + c.Bucket + `/` + key
+	if c.VirtualHost {
+		u.Host = c.Bucket + `.` + u.Host
+		objectPath = `/` + key
+	}
+	u.Path = strings.TrimRight(u.Path, `/`) + objectPath
+	u.RawPath = utils.AwsEscape(u.Path, false)
+	if query != nil {
+		u.RawQuery = strings.ReplaceAll(query.Encode(), `+`, `%20`)
+	}
+	return u.String(), nil
+}
+
+func (c *S3Config) keyRegexp() *regexp.Regexp {
+	var parts = strings.Split(c.KeyPattern, `{version}`)
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(regexp.QuoteMeta(part), `\*`, `.*`)
+	}
+	return regexp.MustCompile(`^` + strings.Join(parts, `([0-9A-Za-z.]+)`) + `$`)
+}
+
+func (s *s3Source) list(ctx context.Context) (objects []s3Object, err error) {
+	var config = s.config
+	var token string
+	for {
+		var query = url.Values{`list-type`: {`2`}, `prefix`: {config.Prefix}}
+		if token != `` {
+			query.Set(`continuation-token`, token)
+		}
+		var listUrl, content string
+		if listUrl, err = config.objectUrl(``, query); err != nil {
+			return
+		}
+		if content, _, err = s.pkg.client.RequestText(ctx, listUrl, `GET`, ``); err != nil {
+			return
+		}
+		var result s3ListResult
+		if err = xml.Unmarshal([]byte(content), &result); err != nil {
+			return
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == `` {
+			return
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// exists tells whether the object at key is there. Without the ListBucket
+// permission S3 answers 403 instead of 404 for a missing key.
+func (s *s3Source) exists(ctx context.Context, key string) (found bool, err error) {
+	var objectUrl string
+	if objectUrl, err = s.config.objectUrl(key, nil); err != nil {
+		return
+	}
+	var statusCode uint16
+	if _, statusCode, err = s.pkg.client.RequestText(ctx, objectUrl, `HEAD`, ``); err == nil {
+		return true, nil
+	}
+	if statusCode == http.StatusNotFound || statusCode == http.StatusForbidden {
+		err = nil
+	}
+	return
+}
+
+func (s *s3Source) Latest(ctx context.Context) (manifest Release, err error) {
+	var config = s.config
+	var key string
+	var checksumKey string
+	var etag string
+	if config.LatestKey != `` {
+		var latestUrl string
+		if latestUrl, err = config.objectUrl(config.Prefix+config.LatestKey, nil); err != nil {
+			return
+		}
+		if manifest, err = s.u.RequestVersionManifest(ctx, s.pkg, latestUrl); err != nil {
+			return
+		}
+		key = config.Prefix + strings.ReplaceAll(config.KeyPattern, `{version}`, manifest.Version)
+		if manifest.Sha256 == `` {
+			var found bool
+			if found, err = s.exists(ctx, key+`.sha256`); err != nil {
+				return
+			}
+			if found {
+				checksumKey = key + `.sha256`
+			}
+		}
+	} else {
+		var objects []s3Object
+		if objects, err = s.list(ctx); err != nil {
+			return
+		}
+		var re = config.keyRegexp()
+		var keys = make(map[string]s3Object)
+		for _, object := range objects {
+			keys[object.Key] = object
+			var parts = re.FindStringSubmatch(strings.TrimPrefix(object.Key, config.Prefix))
+			if len(parts) < 2 {
+				continue
+			}
+			if _, ok := version.ParseVersion(parts[1]); !ok {
+				continue
+			}
+			if key != `` {
+				if comp, _ := version.CompareVersion(parts[1], manifest.Version); comp <= 0 {
+					continue
+				}
+			}
+			key, etag = object.Key, strings.Trim(object.ETag, `"`)
+			manifest.Version = parts[1]
+		}
+		if key == `` {
+			err = fmt.Errorf(`no object matching %s in bucket %s`, config.KeyPattern, config.Bucket)
+			return
+		}
+		if _, ok := keys[key+`.sha256`]; ok {
+			checksumKey = key + `.sha256`
+		}
+	}
+	var objectUrl string
+	if objectUrl, err = config.objectUrl(key, nil); err != nil {
+		return
+	}
+	var artifact = Artifact{Uris: UriList{objectUrl}, Checksum: manifest.Sha256}
+	if checksumKey != `` {
+		artifact.ChecksumUri, err = config.objectUrl(checksumKey, nil)
+	} else if artifact.Checksum == `` && config.VerifyETag && etag != `` && !strings.Contains(etag, `-`) {
+		artifact.Checksum = `md5:` + etag
+	}
+	manifest.Artifacts = []Artifact{artifact}
+	return
+}
@@ -0,0 +1,177 @@
+package upgrader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+type PackageState struct {
+	LastCheck     time.Time `json:"lastCheck,omitempty"`
+	LocalVersion  string    `json:"localVersion,omitempty"`
+	RemoteVersion string    `json:"remoteVersion,omitempty"`
+	LastUpgrade   time.Time `json:"lastUpgrade,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextCheck     time.Time `json:"nextCheck,omitempty"`
+	// SkipVersion is a version rolled back from, which is not installed
+	// again.
+	SkipVersion string `json:"skipVersion,omitempty"`
+	// Staged is an upgrade waiting for the application to shut down.
+	Staged *UpgradeReadyInfo `json:"staged,omitempty"`
+	// DeferredUntil is set by the application to hold scheduled upgrades
+	// back while it is busy.
+	DeferredUntil time.Time `json:"deferredUntil,omitempty"`
+	// Probation is an installed version that still has to prove healthy.
+	Probation *Probation `json:"probation,omitempty"`
+	// Files lists the paths of the installed release when it was synced
+	// from the blob store, so that files it drops can be removed.
+	Files []string `json:"files,omitempty"`
+
+	VersionCache map[string]versionCacheEntry `json:"versionCache,omitempty"`
+}
+
+// Probation records an installed version on trial and what to go back to if
+// it does not turn healthy by Deadline.
+type Probation struct {
+	Version  string    `json:"version"`
+	Previous string    `json:"previous"`
+	Backup   string    `json:"backup"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type versionCacheEntry struct {
+	utils.Validators
+	Body string `json:"body"`
+}
+
+// stateVersion is the layout of the state file. Version 1 holds the staged
+// upgrades that were kept in upgrade.ready before.
+const stateVersion = 1
+
+// State holds what the pipeline knows about each package. A state loaded
+// from a file is written back to it with Save, atomically, so that a crash
+// leaves either the old or the new state.
+type State struct {
+	mutex    sync.Mutex
+	filename string
+	Version  int  `json:"version"`
+	Paused   bool `json:"paused,omitempty"`
+	// MachineID stands in for a machine ID the host does not provide.
+	MachineID string                   `json:"machineId,omitempty"`
+	Packages  map[string]*PackageState `json:"packages"`
+}
+
+// NewState returns an empty state that is not saved anywhere.
+func NewState() *State {
+	return &State{Version: stateVersion, Packages: make(map[string]*PackageState)}
+}
+
+func LoadState(filename string) *State {
+	var state = &State{}
+	if ok := utils.ReadJsonFile(filename, state); !ok || state.Packages == nil {
+		state.Packages = make(map[string]*PackageState)
+	}
+	state.filename = filename
+	return state
+}
+
+func (s *State) Update(name string, fn func(state *PackageState)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var state, ok = s.Packages[name]
+	if !ok {
+		state = &PackageState{}
+		s.Packages[name] = state
+	}
+	fn(state)
+}
+
+func (s *State) Get(name string) (state PackageState, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var item *PackageState
+	if item, ok = s.Packages[name]; ok {
+		state = *item
+		state.VersionCache = nil
+		if item.Staged != nil {
+			var staged = *item.Staged
+			state.Staged = &staged
+		}
+		if item.Probation != nil {
+			var probation = *item.Probation
+			state.Probation = &probation
+		}
+	}
+	return
+}
+
+// SetPaused records whether scheduled upgrades are paused. The pipeline
+// itself does not look at it; it is kept here so that it survives restarts.
+func (s *State) SetPaused(paused bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Paused = paused
+}
+
+func (s *State) IsPaused() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Paused
+}
+
+// machineID returns the random ID kept in the state, generating and saving
+// it on first use, so that hosts without a machine ID do not all fall into
+// the same rollout bucket.
+func (s *State) machineID() (id string, err error) {
+	s.mutex.Lock()
+	var generated = s.MachineID == ``
+	if generated {
+		var buffer = make([]byte, 16)
+		if _, err = rand.Read(buffer); err != nil {
+			s.mutex.Unlock()
+			return
+		}
+		s.MachineID = hex.EncodeToString(buffer)
+	}
+	id = s.MachineID
+	s.mutex.Unlock()
+	if generated {
+		err = s.Save()
+	}
+	return
+}
+
+func (s *State) versionCache(name, uri string) (entry versionCacheEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if item, ok := s.Packages[name]; ok && item.VersionCache != nil {
+		entry = item.VersionCache[uri]
+	}
+	return
+}
+
+// staged returns every staged upgrade by package name.
+func (s *State) staged() map[string]UpgradeReadyInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var staged = make(map[string]UpgradeReadyInfo)
+	for name, item := range s.Packages {
+		if item.Staged != nil {
+			staged[name] = *item.Staged
+		}
+	}
+	return staged
+}
+
+// Save writes the state to the file it was loaded from.
+func (s *State) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.filename == `` {
+		return nil
+	}
+	return utils.WriteJsonFile(s.filename, s)
+}
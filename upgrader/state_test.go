@@ -0,0 +1,29 @@
+package upgrader
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGeneratedMachineID(t *testing.T) {
+	var filename = filepath.Join(t.TempDir(), `state.json`)
+	var dir = t.TempDir()
+	var options = Options{Logger: testLogger{}, CacheDirectory: filepath.Join(dir, `cache`), UpgradeReadyFile: filepath.Join(dir, `upgrade.ready`)}
+	options.State = LoadState(filename)
+	var first = New(options).machineID
+	if len(first) != 32 {
+		t.Fatalf(`generated machine id %q`, first)
+	}
+	options.State = LoadState(filename)
+	if id := New(options).machineID; id != first {
+		t.Errorf(`machine id %q after a restart, want the saved %q`, id, first)
+	}
+	options.State = LoadState(filepath.Join(t.TempDir(), `state.json`))
+	if id := New(options).machineID; id == first {
+		t.Errorf(`two hosts share the generated machine id %q`, id)
+	}
+	options.State, options.MachineID = LoadState(filename), `host-id`
+	if id := New(options).machineID; id != `host-id` {
+		t.Errorf(`machine id %q, want the one the host provides`, id)
+	}
+}
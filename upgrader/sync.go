@@ -0,0 +1,157 @@
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+)
+
+var reSha256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// FileEntry is a file of a release listed in the version manifest. Its
+// content is stored in the blob store under its SHA-256.
+type FileEntry struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+func (f FileEntry) target(dir string) (string, error) {
+	var rel = filepath.Clean(filepath.FromSlash(f.Path))
+	if f.Path == `` || filepath.IsAbs(rel) || rel == `..` || strings.HasPrefix(rel, `..`+string(filepath.Separator)) {
+		return ``, fmt.Errorf(`invalid file path in manifest: %s`, f.Path)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+func (f FileEntry) validate() error {
+	if !reSha256.MatchString(f.Sha256) {
+		return fmt.Errorf(`invalid sha256 in manifest for %s: %q`, f.Path, f.Sha256)
+	}
+	var _, err = f.target(``)
+	return err
+}
+
+func (f FileEntry) perm() os.FileMode {
+	if mode, err := strconv.ParseUint(f.Mode, 8, 32); err == nil && mode > 0 {
+		return os.FileMode(mode) & os.ModePerm
+	}
+	return 0644
+}
+
+// filePaths returns the paths of files.
+func filePaths(files []FileEntry) (paths []string) {
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	return
+}
+
+// removedFiles returns the paths of installed that paths no longer lists.
+func removedFiles(installed, paths []string) (removed []string) {
+	var listed = make(map[string]bool, len(paths))
+	for _, path := range paths {
+		listed[filepath.Clean(filepath.FromSlash(path))] = true
+	}
+	for _, path := range installed {
+		if !listed[filepath.Clean(filepath.FromSlash(path))] {
+			removed = append(removed, path)
+		}
+	}
+	return
+}
+
+// changedFiles returns the entries whose file in dir is missing or differs in
+// size or SHA-256.
+func changedFiles(dir string, files []FileEntry) (changed []FileEntry, err error) {
+	for _, file := range files {
+		var target string
+		if target, err = file.target(dir); err != nil {
+			return
+		}
+		if info, e := os.Stat(target); e == nil && !info.IsDir() && info.Size() == file.Size {
+			if sum, e := utils.FileSha256(target); e == nil && strings.EqualFold(sum, file.Sha256) {
+				continue
+			}
+		}
+		changed = append(changed, file)
+	}
+	return
+}
+
+// syncFiles downloads the files of release that differ from WorkDirectory
+// from the blob store into a new temporary directory next to it, so that only
+// they are swapped in.
+func (u *Upgrader) syncFiles(ctx context.Context, pkg *Package, release Release) (dir string, err error) {
+	if len(pkg.UriBlobs) == 0 {
+		err = errors.New(`uriBlobs is required for manifests listing files`)
+		return
+	}
+	for _, file := range release.Files {
+		if err = file.validate(); err != nil {
+			return
+		}
+	}
+	var changed []FileEntry
+	if changed, err = changedFiles(pkg.WorkDirectory, release.Files); err != nil {
+		return
+	}
+	if dir, err = utils.TempDirBeside(pkg.WorkDirectory, `upgrade`); err != nil {
+		return
+	}
+	var started = time.Now()
+	var bytes int64
+	for _, file := range changed {
+		if err = u.fetchBlob(ctx, pkg, file, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			if !IsCancelled(err) {
+				u.Notify(Event{Type: EventDownloadFailed, Package: pkg.Name, Version: release.Version, Url: pkg.UriBlobs.Primary(), Checksum: file.Sha256, Error: err.Error()})
+			}
+			return
+		}
+		bytes += file.Size
+	}
+	u.Notify(Event{Type: EventDownloadSucceeded, Package: pkg.Name, Version: release.Version, Url: pkg.UriBlobs.Primary(), Bytes: bytes, Duration: time.Since(started)})
+	u.log(logging.Info, fmt.Sprintf(`%d of %d files changed`, len(changed), len(release.Files)), logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseSync})
+	return
+}
+
+func (u *Upgrader) fetchBlob(ctx context.Context, pkg *Package, file FileEntry, dir string) (err error) {
+	var target string
+	if target, err = file.target(dir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return
+	}
+	var sum = file.Sha256
+	return u.mirrors.try(pkg.UriBlobs, pkg.MirrorStrategy, func(uri string) (err error) {
+		if err = pkg.client.ResumeDownload(ctx, target, strings.TrimRight(uri, `/`)+`/`+sum, u.cache.limiter, pkg.limiter); err != nil {
+			return
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(target); err == nil && info.Size() != file.Size {
+			err = fmt.Errorf(`size mismatch for %s: expected %d, got %d`, file.Path, file.Size, info.Size())
+		}
+		if err == nil {
+			err = verifyChecksum(target, sum)
+		}
+		if err == nil {
+			err = os.Chmod(target, file.perm())
+		}
+		if err != nil {
+			_ = os.Remove(target)
+		}
+		return
+	})
+}
@@ -0,0 +1,103 @@
+package upgrader
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newBlobServer serves blobs under their SHA-256 and counts the requests.
+func newBlobServer(t *testing.T, blobs ...string) (*httptest.Server, *int32) {
+	var requests int32
+	var content = make(map[string]string)
+	for _, blob := range blobs {
+		content[sha256Hex([]byte(blob))] = blob
+	}
+	var s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if blob, ok := content[strings.TrimPrefix(r.URL.Path, `/blobs/`)]; ok {
+			_, _ = w.Write([]byte(blob))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s, &requests
+}
+
+func newSyncPackage(t *testing.T, u *Upgrader, s *httptest.Server) *Package {
+	var pkg = newTestPackage(t, `1.0.0`)
+	pkg.Source.Type, pkg.DropFolder = sourceDropFolder, t.TempDir()
+	pkg.UriBlobs = UriList{s.URL + `/blobs`}
+	if err := u.Prepare(pkg); err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func fileEntry(path, content string) FileEntry {
+	return FileEntry{Path: path, Sha256: sha256Hex([]byte(content)), Size: int64(len(content))}
+}
+
+func TestSyncFiles(t *testing.T) {
+	var s, requests = newBlobServer(t, `2`, `plugin`)
+	var u = newTestUpgrader(t)
+	var pkg = newSyncPackage(t, u, s)
+	for name, content := range map[string]string{`bin/app`: `1`, `lib/old.so`: `old`, `share/readme`: `readme`, `data/app.db`: `data`} {
+		var filename = filepath.Join(pkg.WorkDirectory, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.state.Update(pkg.Name, func(state *PackageState) {
+		state.Files = []string{`bin/app`, `lib/old.so`, `share/readme`}
+	})
+	var release = Release{Version: `1.1.0`, Files: []FileEntry{
+		fileEntry(`bin/app`, `2`),
+		fileEntry(`lib/new/plugin.so`, `plugin`),
+		fileEntry(`share/readme`, `readme`),
+	}}
+	var dir, err = u.Download(context.Background(), pkg, release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Install(context.Background(), pkg, release, dir); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 2 {
+		t.Errorf(`fetched %d blobs, want only the 2 changed files`, *requests)
+	}
+	for name, want := range map[string]string{`bin/app`: `2`, `lib/new/plugin.so`: `plugin`, `share/readme`: `readme`, `data/app.db`: `data`, `lib/old.so`: ``} {
+		var content, err = ioutil.ReadFile(filepath.Join(pkg.WorkDirectory, filepath.FromSlash(name)))
+		if want == `` && !os.IsNotExist(err) {
+			t.Errorf(`%s was dropped from the manifest but not removed`, name)
+		} else if want != `` && string(content) != want {
+			t.Errorf(`%s holds %q, want %q`, name, content, want)
+		}
+	}
+	if state, _ := u.state.Get(pkg.Name); strings.Join(state.Files, ` `) != `bin/app lib/new/plugin.so share/readme` {
+		t.Errorf(`state lists installed files %v`, state.Files)
+	}
+}
+
+func TestSyncFilesInvalidSha256(t *testing.T) {
+	for _, sum := range []string{``, `../x`, `a?b`, strings.Repeat(`A`, 64), strings.Repeat(`0`, 63), `sha256:` + strings.Repeat(`0`, 64)} {
+		var s, requests = newBlobServer(t)
+		var u = newTestUpgrader(t)
+		var pkg = newSyncPackage(t, u, s)
+		var release = Release{Version: `1.1.0`, Files: []FileEntry{fileEntry(`bin/app`, `2`), {Path: `bin/tool`, Sha256: sum, Size: 1}}}
+		if _, err := u.Download(context.Background(), pkg, release); err == nil || !strings.Contains(err.Error(), `invalid sha256`) {
+			t.Errorf(`sha256 %q: got error %v, want an invalid sha256`, sum, err)
+		}
+		if *requests != 0 {
+			t.Errorf(`sha256 %q: fetched %d blobs before validating the manifest`, sum, *requests)
+		}
+	}
+}
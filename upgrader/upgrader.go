@@ -0,0 +1,457 @@
+// Package upgrader implements the check, download and install pipeline of
+// daemonupgrader. Every stage is an interface whose implementation is chosen
+// by type name from a registry, so programs embedding the upgrader can add
+// their own sources, fetchers, verifiers, extractors, installers and
+// notifiers.
+package upgrader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vrherog/daemonupgrader/logging"
+	"github.com/vrherog/daemonupgrader/utils"
+	"github.com/vrherog/daemonupgrader/version"
+)
+
+var ErrStopping = errors.New(`daemon is stopping`)
+
+func IsCancelled(err error) bool {
+	return err == ErrStopping || errors.Is(err, context.Canceled)
+}
+
+// Logger is the subset of the kardianos service.Logger used by the pipeline.
+type Logger interface {
+	Error(v ...interface{}) error
+	Warning(v ...interface{}) error
+	Info(v ...interface{}) error
+	Errorf(format string, a ...interface{}) error
+	Warningf(format string, a ...interface{}) error
+	Infof(format string, a ...interface{}) error
+}
+
+// FieldLogger is a Logger that keeps structured fields, such as
+// *logging.Logger. Other loggers get the fields appended to the message.
+type FieldLogger interface {
+	Logger
+	Log(level logging.Level, message string, fields logging.Fields)
+}
+
+// Phases of the pipeline, as logged in the phase field.
+const (
+	phaseCheck    = `check`
+	phaseDownload = `download`
+	phasePatch    = `patch`
+	phaseSync     = `sync`
+	phaseInstall  = `install`
+	phaseRollback = `rollback`
+	phaseNotify   = `notify`
+)
+
+type Options struct {
+	Logger    Logger
+	MachineID string
+	// Http holds the client settings each package's http block is merged
+	// into.
+	Http           utils.HttpOptions
+	RateLimit      utils.ByteSize
+	CacheDirectory string
+	CacheKeep      int
+	Concurrency    Concurrency
+	// UpgradeReadyFile is where the staged installer publishes upgrades for
+	// applications that need to shut down first.
+	UpgradeReadyFile string
+	// State is saved by the pipeline itself whenever a staged upgrade
+	// changes, if it was loaded with LoadState.
+	State *State
+	// InstallContext, when set, replaces the caller's context while files
+	// are being copied, so that a shutdown can let installs finish.
+	InstallContext context.Context
+}
+
+type Upgrader struct {
+	Checks    WorkerPool
+	Downloads WorkerPool
+	Installs  WorkerPool
+
+	logger     Logger
+	machineID  string
+	http       utils.HttpOptions
+	readyFile  string
+	state      *State
+	cache      *downloadCache
+	mirrors    *mirrorHealth
+	installCtx context.Context
+	mutex      sync.Mutex
+	notifiers  []Notifier
+}
+
+func New(options Options) *Upgrader {
+	var u = &Upgrader{
+		Checks:     NewWorkerPool(options.Concurrency.Checks, defaultMaxChecks),
+		Downloads:  NewWorkerPool(options.Concurrency.Downloads, defaultMaxDownloads),
+		Installs:   NewWorkerPool(options.Concurrency.Installs, defaultMaxInstalls),
+		logger:     options.Logger,
+		machineID:  options.MachineID,
+		http:       options.Http,
+		readyFile:  options.UpgradeReadyFile,
+		state:      options.State,
+		mirrors:    newMirrorHealth(),
+		installCtx: options.InstallContext,
+	}
+	if u.logger == nil {
+		u.logger = stdLogger{}
+	}
+	if u.state == nil {
+		u.state = NewState()
+	}
+	if u.readyFile == `` {
+		u.readyFile = `upgrade.ready`
+	}
+	var keep = options.CacheKeep
+	if keep < 1 {
+		keep = 2
+	}
+	var dir = options.CacheDirectory
+	if dir == `` {
+		dir = `cache`
+	}
+	u.cache = &downloadCache{dir: dir, keep: keep, limiter: utils.NewRateLimiter(options.RateLimit)}
+	if u.machineID == `` {
+		var err error
+		if u.machineID, err = u.state.machineID(); err != nil {
+			u.log(logging.Warning, `save generated machine id failed`, logging.Fields{Error: err.Error()})
+		}
+	}
+	u.migrateReadyFile()
+	return u
+}
+
+func (u *Upgrader) State() *State {
+	return u.state
+}
+
+func (u *Upgrader) Logger() Logger {
+	return u.logger
+}
+
+func (u *Upgrader) installContext(ctx context.Context) context.Context {
+	if u.installCtx != nil {
+		return u.installCtx
+	}
+	return ctx
+}
+
+// Prepare builds the HTTP client of pkg and creates its pipeline stages from
+// the registry. The default source is http when uriCheckVersion is set and
+// drop-folder otherwise; a dropFolder next to any other source offers the
+// archives found there as well.
+func (u *Upgrader) Prepare(pkg *Package) (err error) {
+	if !pkg.Validate() {
+		return errors.New(`name, workDirectory and commandGetVersion are required`)
+	}
+	if pkg.client, err = utils.NewHttpClient(u.http.Merge(pkg.Http)); err != nil {
+		return
+	}
+	var auth = pkg.HttpAuth
+	if len(auth.Hosts) == 0 {
+		auth.Hosts = pkg.serverHosts()
+	}
+	pkg.client = pkg.client.WithAuth(auth)
+	pkg.limiter = utils.NewRateLimiter(pkg.RateLimit)
+	var sourceType = pkg.Source.Type
+	if sourceType == `` {
+		if len(pkg.UriCheckVersion) > 0 {
+			sourceType = sourceHttp
+		} else {
+			sourceType = sourceDropFolder
+		}
+	}
+	if pkg.source, err = newSource(u, pkg, sourceType); err != nil {
+		return
+	}
+	if pkg.DropFolder != `` && sourceType != sourceDropFolder {
+		pkg.source = &dropFolderSource{u: u, pkg: pkg, dir: pkg.DropFolder, next: pkg.source}
+	}
+	if pkg.fetcher, err = newFetcher(u, pkg, stageType(pkg.Fetcher, fetcherCache)); err != nil {
+		return
+	}
+	if pkg.verifier, err = newVerifier(u, pkg, stageType(pkg.Verifier, verifierChecksum)); err != nil {
+		return
+	}
+	if pkg.extractor, err = newExtractor(u, pkg, stageType(pkg.Extractor, extractorArchive)); err != nil {
+		return
+	}
+	var installer = installerCopy
+	if pkg.NeedShutdown {
+		installer = installerStaged
+	}
+	pkg.installer, err = newInstaller(u, pkg, stageType(pkg.Installer, installer))
+	return
+}
+
+func stageType(config StageConfig, defaultType string) string {
+	if config.Type == `` {
+		return defaultType
+	}
+	return config.Type
+}
+
+// WaitDue is called before a scheduled Upgrade. It reports false when the
+// update server asked to back off until later, the application deferred its
+// upgrades or ctx is done, and otherwise waits a random delay of up to
+// pkg.Jitter, if set.
+func (u *Upgrader) WaitDue(ctx context.Context, pkg *Package) bool {
+	if state, ok := u.state.Get(pkg.Name); ok && (time.Now().Before(state.NextCheck) || time.Now().Before(state.DeferredUntil)) {
+		return false
+	}
+	if pkg.Jitter == nil {
+		return true
+	}
+	if delay := randomJitter(*pkg.Jitter); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Upgrade runs the whole pipeline for pkg once: it checks for a newer release
+// and downloads, verifies, extracts and installs it. The outcome is recorded
+// in the state, including when the update server asked to back off.
+func (u *Upgrader) Upgrade(ctx context.Context, pkg *Package) (err error) {
+	var release Release
+	var needed bool
+	release, needed, err = u.Check(ctx, pkg)
+	if err == nil {
+		u.Notify(Event{Type: EventCheckSucceeded, Package: pkg.Name, Version: release.Version})
+	} else if !IsCancelled(err) {
+		u.Notify(Event{Type: EventCheckFailed, Package: pkg.Name, Error: err.Error()})
+	}
+	if err == nil && needed {
+		var started = time.Now()
+		u.Notify(Event{Type: EventUpgradeStarted, Package: pkg.Name, Version: release.Version})
+		var dir string
+		var staged bool
+		if dir, err = u.Download(ctx, pkg, release); err == nil {
+			staged, err = u.Install(ctx, pkg, release, dir)
+		}
+		var event = Event{Package: pkg.Name, Version: release.Version, Checksum: release.Sha256, Duration: time.Since(started)}
+		if len(release.Artifacts) > 0 {
+			event.Url = release.Artifacts[0].Uris.Primary()
+		} else if len(release.Files) > 0 {
+			event.Url = pkg.UriBlobs.Primary()
+		}
+		if err == nil && staged {
+			event.Type = EventUpgradeStaged
+		} else if err == nil {
+			event.Type = EventUpgradeSucceeded
+		} else if !IsCancelled(err) {
+			event.Type, event.Error = EventUpgradeFailed, err.Error()
+		}
+		if event.Type != `` {
+			u.Notify(event)
+		}
+	}
+	if IsCancelled(err) || ctx.Err() != nil {
+		return
+	}
+	u.state.Update(pkg.Name, func(state *PackageState) {
+		state.LastCheck = time.Now()
+		if err != nil {
+			state.LastError = err.Error()
+		} else {
+			state.LastError = ``
+		}
+		if delay, ok := retryDelay(err); ok {
+			state.NextCheck = state.LastCheck.Add(delay)
+			u.log(logging.Warning, `throttled by the update server, next check after `+state.NextCheck.Format(time.RFC3339),
+				logging.Fields{Package: pkg.Name, Phase: phaseCheck})
+		}
+	})
+	return
+}
+
+// Check asks the source of pkg for the latest release and reports whether it
+// is newer than the installed version, rolled out to this host and not
+// already staged.
+func (u *Upgrader) Check(ctx context.Context, pkg *Package) (release Release, needed bool, err error) {
+	var dirInfo os.FileInfo
+	if dirInfo, err = os.Stat(pkg.WorkDirectory); err != nil || !dirInfo.IsDir() {
+		if err == nil {
+			err = fmt.Errorf(`%s is not a directory`, pkg.WorkDirectory)
+		}
+		return
+	}
+	if !u.Checks.Acquire(ctx) {
+		err = ErrStopping
+		return
+	}
+	defer u.Checks.Release()
+	if release, err = pkg.source.Latest(ctx); err != nil || release.Version == `` {
+		return
+	}
+	var remoteVer = release.Version
+	var localVer string
+	if pkg.LocalVersion != nil {
+		localVer, err = pkg.LocalVersion(ctx)
+	} else {
+		localVer, err = utils.ExecCommandString(ctx, pkg.CommandGetVersion)
+	}
+	if err != nil || localVer == `` {
+		return
+	}
+	localVer = strings.TrimSpace(localVer)
+	u.state.Update(pkg.Name, func(state *PackageState) {
+		state.LocalVersion = localVer
+		state.RemoteVersion = remoteVer
+	})
+	var comp, ok = version.CompareVersion(remoteVer, localVer)
+	if ok && comp == 0 && len(release.Files) > 0 {
+		var changed []FileEntry
+		if changed, err = changedFiles(pkg.WorkDirectory, release.Files); err == nil && len(changed) > 0 {
+			u.log(logging.Warning, fmt.Sprintf(`%d files differ from the installed version, restoring them, first: %s`, len(changed), changed[0].Path),
+				logging.Fields{Package: pkg.Name, Version: remoteVer, Phase: phaseCheck})
+			needed = true
+		}
+		return
+	}
+	if ok && comp == 1 && !u.skipped(pkg.Name, remoteVer) && u.rolledOut(pkg.Name, release) {
+		if info, ok := u.Staged(pkg.Name); ok {
+			if comp, ok := version.CompareVersion(info.Version, remoteVer); ok && comp >= 0 {
+				return
+			}
+		}
+		needed = true
+	}
+	return
+}
+
+// skipped reports whether remoteVer is not newer than a version that was
+// rolled back from.
+func (u *Upgrader) skipped(name, remoteVer string) bool {
+	var state, _ = u.state.Get(name)
+	if state.SkipVersion == `` {
+		return false
+	}
+	var comp, ok = version.CompareVersion(remoteVer, state.SkipVersion)
+	return ok && comp <= 0
+}
+
+// Download fetches and verifies every artifact of release and extracts them
+// into a new temporary directory.
+func (u *Upgrader) Download(ctx context.Context, pkg *Package, release Release) (dir string, err error) {
+	if !u.Downloads.Acquire(ctx) {
+		err = ErrStopping
+		return
+	}
+	defer u.Downloads.Release()
+	u.log(logging.Info, `new version found`, logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseDownload})
+	var started = time.Now()
+	if len(release.Files) > 0 {
+		return u.syncFiles(ctx, pkg, release)
+	}
+	var packageFiles = make([]string, 0, len(release.Artifacts))
+	for _, artifact := range release.Artifacts {
+		if artifact.Checksum, err = u.requestChecksum(ctx, pkg, artifact); err != nil {
+			return
+		}
+		var packageFile string
+		if packageFile, err = pkg.fetcher.Fetch(ctx, release, artifact); err != nil {
+			return
+		}
+		packageFiles = append(packageFiles, packageFile)
+	}
+	if dir, err = ioutil.TempDir(os.TempDir(), `upgrade`); err != nil {
+		return
+	}
+	for _, packageFile := range packageFiles {
+		if err = pkg.extractor.Extract(ctx, packageFile, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			return
+		}
+	}
+	u.log(logging.Info, `download completed`, logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseDownload, Duration: time.Since(started)})
+	return
+}
+
+// Install hands dir to the installer of pkg and records the new version. dir
+// is removed afterwards unless the installer staged it.
+func (u *Upgrader) Install(ctx context.Context, pkg *Package, release Release, dir string) (staged bool, err error) {
+	var started = time.Now()
+	if staged, err = pkg.installer.Install(ctx, release, dir); err != nil || !staged {
+		_ = os.RemoveAll(dir)
+	}
+	if err != nil {
+		return
+	}
+	if staged {
+		u.log(logging.Info, `upgrade staged`, logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseInstall})
+		return
+	}
+	u.state.Update(pkg.Name, func(state *PackageState) {
+		state.LocalVersion = release.Version
+		state.LastUpgrade = time.Now()
+		state.Files = filePaths(release.Files)
+		state.SkipVersion = ``
+	})
+	u.log(logging.Info, `upgrade completed`, logging.Fields{Package: pkg.Name, Version: release.Version, Phase: phaseInstall, Duration: time.Since(started)})
+	return
+}
+
+func (u *Upgrader) log(level logging.Level, message string, fields logging.Fields) {
+	if l, ok := u.logger.(FieldLogger); ok {
+		l.Log(level, message, fields)
+		return
+	}
+	var text = logging.Entry{Message: message, Fields: fields}.Text()
+	switch level {
+	case logging.Error:
+		_ = u.logger.Error(text)
+	case logging.Warning:
+		_ = u.logger.Warning(text)
+	case logging.Info:
+		_ = u.logger.Info(text)
+	}
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Error(v ...interface{}) error {
+	log.Print(append([]interface{}{`E `}, v...)...)
+	return nil
+}
+
+func (stdLogger) Warning(v ...interface{}) error {
+	log.Print(append([]interface{}{`W `}, v...)...)
+	return nil
+}
+
+func (stdLogger) Info(v ...interface{}) error {
+	log.Print(append([]interface{}{`I `}, v...)...)
+	return nil
+}
+
+func (stdLogger) Errorf(format string, a ...interface{}) error {
+	log.Printf(`E `+format, a...)
+	return nil
+}
+
+func (stdLogger) Warningf(format string, a ...interface{}) error {
+	log.Printf(`W `+format, a...)
+	return nil
+}
+
+func (stdLogger) Infof(format string, a ...interface{}) error {
+	log.Printf(`I `+format, a...)
+	return nil
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+}
+
+type HttpAuth struct {
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	BearerTokenFile string            `yaml:"bearerTokenFile,omitempty"`
+	BasicAuth       *BasicAuth        `yaml:"basicAuth,omitempty"`
+	// Hosts limits the credentials to requests to these hosts, written as
+	// host or host:port. Empty sends them everywhere.
+	Hosts []string `yaml:"authHosts,omitempty"`
+}
+
+// authHeadersKey keys the names of the headers Apply set in the context of
+// a request, so that a redirect to another host can drop them.
+type authHeadersKey struct{}
+
+// ResolveSecret returns value itself, or the content of an environment
+// variable or a file when value is written as env:NAME or file:/path.
+func ResolveSecret(value string) (result string, err error) {
+	switch {
+	case strings.HasPrefix(value, `env:`):
+		var ok bool
+		if result, ok = os.LookupEnv(value[4:]); !ok {
+			err = fmt.Errorf(`environment variable %s is not set`, value[4:])
+		}
+	case strings.HasPrefix(value, `file:`):
+		result, err = readSecretFile(value[5:])
+	default:
+		result = value
+	}
+	return
+}
+
+func readSecretFile(filename string) (result string, err error) {
+	var buffer []byte
+	if buffer, err = ioutil.ReadFile(filename); err == nil {
+		result = strings.TrimSpace(string(buffer))
+	}
+	return
+}
+
+func (a *HttpAuth) IsEmpty() bool {
+	return len(a.Headers) == 0 && a.BearerTokenFile == `` && a.BasicAuth == nil
+}
+
+// Allows reports whether the credentials may be sent to the host of u.
+func (a *HttpAuth) Allows(u *url.URL) bool {
+	if len(a.Hosts) == 0 {
+		return true
+	}
+	for _, host := range a.Hosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerNames returns the names of the headers Apply sets.
+func (a *HttpAuth) headerNames() (names []string) {
+	for name := range a.Headers {
+		names = append(names, name)
+	}
+	if a.BearerTokenFile != `` || a.BasicAuth != nil {
+		names = append(names, `Authorization`)
+	}
+	return
+}
+
+// Apply adds the credentials to req unless its host is out of scope.
+func (a *HttpAuth) Apply(req *http.Request) (err error) {
+	if !a.Allows(req.URL) {
+		return
+	}
+	for name, value := range a.Headers {
+		if value, err = ResolveSecret(value); err != nil {
+			return
+		}
+		req.Header.Set(name, value)
+	}
+	if a.BearerTokenFile != `` {
+		var token string
+		if token, err = readSecretFile(a.BearerTokenFile); err != nil {
+			return
+		}
+		req.Header.Set(`Authorization`, `Bearer `+token)
+	}
+	if a.BasicAuth != nil {
+		var username, password string
+		if username, err = ResolveSecret(a.BasicAuth.Username); err != nil {
+			return
+		}
+		if a.BasicAuth.PasswordFile != `` {
+			password, err = readSecretFile(a.BasicAuth.PasswordFile)
+		} else {
+			password, err = ResolveSecret(a.BasicAuth.Password)
+		}
+		if err != nil {
+			return
+		}
+		req.SetBasicAuth(username, password)
+	}
+	return
+}
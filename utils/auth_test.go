@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestHttpAuthAllows(t *testing.T) {
+	var auth = HttpAuth{Hosts: []string{`updates.example.com`, `mirror.example.com:8443`}}
+	var tests = []struct {
+		uri string
+		ok  bool
+	}{
+		{`https://updates.example.com/version`, true},
+		{`https://UPDATES.example.com:8080/version`, true},
+		{`https://mirror.example.com:8443/app.zip`, true},
+		{`https://mirror.example.com/app.zip`, false},
+		{`https://cdn.example.com/app.zip`, false},
+		{`https://updates.example.com.evil.test/version`, false},
+	}
+	for _, test := range tests {
+		var u, _ = url.Parse(test.uri)
+		if ok := auth.Allows(u); ok != test.ok {
+			t.Errorf(`Allows(%s) = %t, want %t`, test.uri, ok, test.ok)
+		}
+	}
+	var u, _ = url.Parse(`https://anywhere.example.com/`)
+	if !(&HttpAuth{}).Allows(u) {
+		t.Errorf(`credentials without hosts are not sent everywhere`)
+	}
+}
+
+func TestHttpAuthScope(t *testing.T) {
+	var mutex sync.Mutex
+	var seen = make(map[string][2]string)
+	var record = func(name string, r *http.Request) {
+		mutex.Lock()
+		seen[name] = [2]string{r.Header.Get(`X-Api-Key`), r.Header.Get(`Authorization`)}
+		mutex.Unlock()
+	}
+	var other = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(`other`+r.URL.Path, r)
+	}))
+	defer other.Close()
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r.URL.Path, r)
+		switch r.URL.Path {
+		case `/away`:
+			http.Redirect(w, r, other.URL+`/redirected`, http.StatusFound)
+		case `/here`:
+			http.Redirect(w, r, `/target`, http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	var serverUrl, _ = url.Parse(server.URL)
+	var client, err = NewHttpClient(HttpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithAuth(HttpAuth{Headers: map[string]string{`X-Api-Key`: `key`}, BasicAuth: &BasicAuth{Username: `app`, Password: `secret`}, Hosts: []string{serverUrl.Host}})
+	for _, uri := range []string{server.URL + `/away`, server.URL + `/here`, other.URL + `/direct`} {
+		if _, _, err = client.RequestText(context.Background(), uri, `GET`, ``); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		request string
+		sent    bool
+	}{
+		{`/away`, true},
+		{`other/redirected`, false},
+		{`/here`, true},
+		{`/target`, true},
+		{`other/direct`, false},
+	}
+	for _, test := range tests {
+		var headers = seen[test.request]
+		if sent := headers[0] == `key` && headers[1] != ``; sent != test.sent || !sent && (headers[0] != `` || headers[1] != ``) {
+			t.Errorf(`%s received X-Api-Key %q, Authorization %q, want credentials: %t`, test.request, headers[0], headers[1], test.sent)
+		}
+	}
+}
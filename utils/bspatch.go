@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const bsdiffMagic = `BSDIFF40`
+
+var errCorruptPatch = errors.New(`corrupt bsdiff patch`)
+
+// offtin decodes the sign-magnitude little endian integers used by bsdiff.
+func offtin(buf []byte) int64 {
+	var y = int64(buf[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(buf[i])
+	}
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+// Bspatch applies a patch created by bsdiff (BSDIFF40 format) to oldFile and
+// writes the result to newFile. The old file is read at random offsets and
+// the new one written sequentially, so neither is held in memory.
+func Bspatch(ctx context.Context, oldFile, patchFile, newFile string) (err error) {
+	var patch []byte
+	if patch, err = ioutil.ReadFile(patchFile); err != nil {
+		return
+	}
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return errCorruptPatch
+	}
+	var ctrlLen, diffLen, newSize = offtin(patch[8:16]), offtin(patch[16:24]), offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return errCorruptPatch
+	}
+	var ctrl = bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	var diff = bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	var extra = bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	var old *os.File
+	if old, err = os.Open(oldFile); err != nil {
+		return
+	}
+	defer old.Close()
+	var info os.FileInfo
+	if info, err = old.Stat(); err != nil {
+		return
+	}
+	var oldSize = info.Size()
+	var out *os.File
+	if out, err = os.Create(newFile); err != nil {
+		return
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+	var writer = bufio.NewWriter(out)
+	var header = make([]byte, 24)
+	var buffer = make([]byte, 64*1024)
+	var oldBuffer = make([]byte, 64*1024)
+	var oldPos, newPos int64
+	for newPos < newSize {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(ctrl, header); err != nil {
+			return errCorruptPatch
+		}
+		var add, copyLen, seek = offtin(header[0:8]), offtin(header[8:16]), offtin(header[16:24])
+		if add < 0 || copyLen < 0 || newPos+add+copyLen > newSize {
+			return errCorruptPatch
+		}
+		for add > 0 {
+			var n = int64(len(buffer))
+			if n > add {
+				n = add
+			}
+			if _, err = io.ReadFull(diff, buffer[:n]); err != nil {
+				return errCorruptPatch
+			}
+			for i := range oldBuffer[:n] {
+				oldBuffer[i] = 0
+			}
+			if oldPos < oldSize && oldPos+n > 0 {
+				var start, offset = oldPos, int64(0)
+				if start < 0 {
+					start, offset = 0, -oldPos
+				}
+				if _, err = old.ReadAt(oldBuffer[offset:n], start); err != nil && err != io.EOF {
+					return
+				}
+				err = nil
+			}
+			for i := int64(0); i < n; i++ {
+				if oldPos+i >= 0 && oldPos+i < oldSize {
+					buffer[i] += oldBuffer[i]
+				}
+			}
+			if _, err = writer.Write(buffer[:n]); err != nil {
+				return
+			}
+			add -= n
+			oldPos += n
+			newPos += n
+		}
+		if copyLen > 0 {
+			if _, err = io.CopyN(writer, extra, copyLen); err != nil {
+				return errCorruptPatch
+			}
+			newPos += copyLen
+		}
+		oldPos += seek
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// bzip2Control and bzip2Blocks hold the bzip2 compressed control blocks,
+// by their add, copy and seek lengths, and diff and extra blocks, by their
+// content, used below. They were made with Python's bz2.compress since the
+// standard library can only decompress bzip2.
+var bzip2Control = map[string]string{
+	"[6 5 0]":        "425a6839314159265359661a900c00000540004b0820002186819a00ad9af177245385090661a900c0",
+	"[3 0 0]":        "425a6839314159265359ffa32513000002600048000800200030cc0cf505ce2ee48a70a121ff464a26",
+	"[3 0 -3 3 0 0]": "425a6839314159265359cea7726800000760405808080040002000212460300f5c21cacb85dc914e142433a9dc9a00",
+	"[4 0 0]":        "425a68393141592653595a2ce8ba000002600044000800200030cc0cf505ce2ee48a70a120b459d174",
+	"[]":             "425a683917724538509000000000",
+	"[5 0 0]":        "425a68393141592653590c837508000002600042000800200030cc0cf505ce2ee48a70a1201906ea10",
+}
+
+var bzip2Blocks = map[string]string{
+	"":                         "425a683917724538509000000000",
+	"\x00\x00\x00\x00\x00":     "425a6839314159265359b8ef446300000040006000200021008283177245385090b8ef4463",
+	"\x00\x00\x00\x00\x00\x00": "425a6839314159265359c585438d00000040005000200021008283177245385090c585438d",
+	"\x01\x01\x01":             "425a68393141592653599f9bf213000001400020002000308c1418bb9229c28484fcdf9098",
+	"\x00\x00XY":               "425a6839314159265359b9facd81000000420040000060200021981984cc2ee48a70a12173f59b02",
+	"there":                    "425a6839314159265359fdd4d8820000020180024014002000219a68334d0cb38bb9229c28487eea6c4100",
+}
+
+func offtout(x int64) []byte {
+	var buf = make([]byte, 8)
+	var y = x
+	if y < 0 {
+		y = -y
+	}
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(y >> (8 * i))
+	}
+	if x < 0 {
+		buf[7] |= 0x80
+	}
+	return buf
+}
+
+func decodeHex(t *testing.T, stream string) []byte {
+	var buffer, err = hex.DecodeString(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+func decompress(t *testing.T, stream string) []byte {
+	var plain, err = ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(decodeHex(t, stream))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func compressed(t *testing.T, streams map[string]string, key string) []byte {
+	var stream, ok = streams[key]
+	if !ok {
+		t.Fatalf(`no bzip2 stream for %q`, key)
+	}
+	return decodeHex(t, stream)
+}
+
+// makePatch assembles a BSDIFF40 patch from control triples of add, copy and
+// seek lengths and the diff and extra blocks.
+func makePatch(t *testing.T, newSize int64, ctrl []int64, diff, extra []byte) []byte {
+	var ctrlBlock = compressed(t, bzip2Control, fmt.Sprint(ctrl))
+	var diffBlock, extraBlock = compressed(t, bzip2Blocks, string(diff)), compressed(t, bzip2Blocks, string(extra))
+	var patch = []byte(bsdiffMagic)
+	patch = append(patch, offtout(int64(len(ctrlBlock)))...)
+	patch = append(patch, offtout(int64(len(diffBlock)))...)
+	patch = append(patch, offtout(newSize)...)
+	patch = append(append(append(patch, ctrlBlock...), diffBlock...), extraBlock...)
+	return patch
+}
+
+func TestBzip2Streams(t *testing.T) {
+	for key, stream := range bzip2Control {
+		var plain = decompress(t, stream)
+		var ctrl []int64
+		for i := 0; i+8 <= len(plain); i += 8 {
+			ctrl = append(ctrl, offtin(plain[i:i+8]))
+		}
+		if got := fmt.Sprint(ctrl); got != key || len(plain)%8 != 0 {
+			t.Errorf(`control stream %s decompresses to %s`, key, got)
+		}
+	}
+	for key, stream := range bzip2Blocks {
+		if plain := decompress(t, stream); string(plain) != key {
+			t.Errorf(`stream for %q decompresses to %q`, key, plain)
+		}
+	}
+}
+
+func TestOfftin(t *testing.T) {
+	for _, x := range []int64{0, 1, -1, 255, 256, -3, 1 << 40, -(1 << 40)} {
+		if got := offtin(offtout(x)); got != x {
+			t.Errorf(`offtin(offtout(%d)) = %d`, x, got)
+		}
+	}
+}
+
+func TestBspatch(t *testing.T) {
+	var tests = []struct {
+		name    string
+		old     string
+		patch   func(t *testing.T) []byte
+		want    string
+		corrupt bool
+	}{
+		{`unchanged prefix and extra`, `hello world`, func(t *testing.T) []byte {
+			return makePatch(t, 11, []int64{6, 5, 0}, make([]byte, 6), []byte(`there`))
+		}, `hello there`, false},
+		{`diff added to old bytes`, `abc`, func(t *testing.T) []byte {
+			return makePatch(t, 3, []int64{3, 0, 0}, []byte{1, 1, 1}, nil)
+		}, `bcd`, false},
+		{`negative seek`, `abcdef`, func(t *testing.T) []byte {
+			return makePatch(t, 6, []int64{3, 0, -3, 3, 0, 0}, make([]byte, 6), nil)
+		}, `abcabc`, false},
+		{`diff past the end of old`, `ab`, func(t *testing.T) []byte {
+			return makePatch(t, 4, []int64{4, 0, 0}, []byte("\x00\x00XY"), nil)
+		}, `abXY`, false},
+		{`empty new file`, `abc`, func(t *testing.T) []byte {
+			return makePatch(t, 0, nil, nil, nil)
+		}, ``, false},
+		{`not a patch`, `abc`, func(t *testing.T) []byte {
+			return []byte(`BSDIFF40 too short`)
+		}, ``, true},
+		{`wrong magic`, `abc`, func(t *testing.T) []byte {
+			var patch = makePatch(t, 3, []int64{3, 0, 0}, []byte{1, 1, 1}, nil)
+			patch[7] = '1'
+			return patch
+		}, ``, true},
+		{`add beyond new size`, `abc`, func(t *testing.T) []byte {
+			return makePatch(t, 3, []int64{5, 0, 0}, make([]byte, 5), nil)
+		}, ``, true},
+		{`control block too short`, `abc`, func(t *testing.T) []byte {
+			return makePatch(t, 3, nil, nil, nil)
+		}, ``, true},
+		{`blocks beyond the patch`, `abc`, func(t *testing.T) []byte {
+			var patch = makePatch(t, 3, []int64{3, 0, 0}, []byte{1, 1, 1}, nil)
+			copy(patch[16:24], offtout(1<<20))
+			return patch
+		}, ``, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dir = t.TempDir()
+			var oldFile, patchFile, newFile = filepath.Join(dir, `old`), filepath.Join(dir, `patch`), filepath.Join(dir, `new`)
+			if err := ioutil.WriteFile(oldFile, []byte(test.old), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(patchFile, test.patch(t), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var err = Bspatch(context.Background(), oldFile, patchFile, newFile)
+			if test.corrupt {
+				if err != errCorruptPatch {
+					t.Fatalf(`got error %v, want %v`, err, errCorruptPatch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, _ = ioutil.ReadFile(newFile)
+			if string(got) != test.want {
+				t.Errorf(`got %q, want %q`, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBspatchCancelled(t *testing.T) {
+	var dir = t.TempDir()
+	var oldFile, patchFile = filepath.Join(dir, `old`), filepath.Join(dir, `patch`)
+	_ = ioutil.WriteFile(oldFile, []byte(`abc`), 0644)
+	_ = ioutil.WriteFile(patchFile, makePatch(t, 3, []int64{3, 0, 0}, []byte{1, 1, 1}, nil), 0644)
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := Bspatch(ctx, oldFile, patchFile, filepath.Join(dir, `new`)); err != context.Canceled {
+		t.Fatalf(`got error %v, want %v`, err, context.Canceled)
+	}
+}
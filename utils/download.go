@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+	Header     http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf(`%s: unexpected status %s`, e.Url, e.Status)
+}
+
+func (e *StatusError) Throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			Url:        resp.Request.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get(`Retry-After`)),
+			Header:     resp.Header,
+		}
+	}
+	return nil
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == `` {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+type partialDownload struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// ResumeDownload downloads url into filename. The content is written to
+// filename.part first, so an interrupted download continues where it stopped
+// on the next call as long as the server still serves the same content.
+func (c *HttpClient) ResumeDownload(ctx context.Context, filename, url string, limiters ...*RateLimiter) (err error) {
+	if src, ok := LocalPath(url); ok {
+		return copyLocalFile(ctx, filename, src, limiters...)
+	}
+	var partFile = filename + `.part`
+	var metaFile = partFile + `.json`
+	var meta partialDownload
+	var offset int64
+	if info, e := os.Stat(partFile); e == nil && ReadJsonFile(metaFile, &meta) && meta.Url == url && (meta.ETag != `` || meta.LastModified != ``) {
+		offset = info.Size()
+	}
+	var resp *http.Response
+	if resp, err = c.do(ctx, func() (req *http.Request, err error) {
+		if req, err = c.newRequest(ctx, url, `GET`, ``); err == nil && offset > 0 {
+			req.Header.Set(`Range`, fmt.Sprintf(`bytes=%d-`, offset))
+			if meta.ETag != `` {
+				req.Header.Set(`If-Range`, meta.ETag)
+			} else {
+				req.Header.Set(`If-Range`, meta.LastModified)
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var flag = os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if offset == 0 {
+			return fmt.Errorf(`%s: partial content without a range request`, url)
+		}
+		if !strings.HasPrefix(resp.Header.Get(`Content-Range`), fmt.Sprintf(`bytes %d-`, offset)) {
+			// The server resumed somewhere else; start over without a range.
+			_ = resp.Body.Close()
+			_ = os.Remove(partFile)
+			_ = os.Remove(metaFile)
+			return c.ResumeDownload(ctx, filename, url, limiters...)
+		}
+		flag |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_ = os.Remove(partFile)
+		_ = os.Remove(metaFile)
+		return &StatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	default:
+		if err = checkStatus(resp); err != nil {
+			return
+		}
+		flag |= os.O_TRUNC
+		meta = partialDownload{Url: url, ETag: resp.Header.Get(`ETag`), LastModified: resp.Header.Get(`Last-Modified`)}
+		if strings.HasPrefix(meta.ETag, `W/`) {
+			meta.ETag = ``
+		}
+		if err = WriteJsonFile(metaFile, meta); err != nil {
+			return
+		}
+	}
+	var fp *os.File
+	if fp, err = os.OpenFile(partFile, flag, 0644); err != nil {
+		return
+	}
+	_, err = io.Copy(fp, NewRateLimitedReader(ctx, resp.Body, limiters...))
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(partFile, filename); err == nil {
+		_ = os.Remove(metaFile)
+	}
+	return
+}
+
+func fileHash(filename string, hash hash.Hash) (sum string, err error) {
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		return
+	}
+	defer fp.Close()
+	if _, err = io.Copy(hash, fp); err == nil {
+		sum = hex.EncodeToString(hash.Sum(nil))
+	}
+	return
+}
+
+func FileSha256(filename string) (string, error) {
+	return fileHash(filename, sha256.New())
+}
+
+func FileMd5(filename string) (string, error) {
+	return fileHash(filename, md5.New())
+}
@@ -5,6 +5,7 @@ import (
 	"archive/zip"
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func Unzip(zipFile, destDir string) (err error) {
@@ -59,12 +61,27 @@ func ExtractGzip(gzipFile, destDir string) (err error) {
 	if err != nil {
 		return
 	}
+	defer fp.Close()
 	var gzipReader *gzip.Reader
 	gzipReader, err = gzip.NewReader(fp)
 	if err != nil {
 		return
 	}
-	var tarReader = tar.NewReader(gzipReader)
+	return extractTar(gzipReader, destDir)
+}
+
+func ExtractTar(tarFile, destDir string) (err error) {
+	var fp *os.File
+	fp, err = os.Open(tarFile)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	return extractTar(fp, destDir)
+}
+
+func extractTar(reader io.Reader, destDir string) (err error) {
+	var tarReader = tar.NewReader(reader)
 	for true {
 		var header *tar.Header
 		header, err = tarReader.Next()
@@ -158,20 +175,31 @@ func ReadJsonFile(filename string, content interface{}) (ok bool) {
 	return
 }
 
-func WriteJsonFile(filename string, v interface{}) (err error) {
+// filePerm returns the permission bits of filename, or 0644 if it does not
+// exist yet.
+func filePerm(filename string) (perm os.FileMode, err error) {
 	var info os.FileInfo
-	if info, err = os.Stat(filename); err == nil || os.IsNotExist(err) || !info.IsDir() {
-		var perm os.FileMode
-		if info != nil {
-			perm = info.Mode()
-		}
-		if perm < 1 {
-			perm = 0644
-		}
-		var buffer []byte
-		if buffer, err = json.Marshal(v); err == nil {
-			err = ioutil.WriteFile(filename, buffer, perm)
+	if info, err = os.Stat(filename); err == nil {
+		if info.IsDir() {
+			return 0, fmt.Errorf(`%s is a directory`, filename)
 		}
+		return info.Mode().Perm(), nil
+	}
+	if os.IsNotExist(err) {
+		return 0644, nil
+	}
+	return
+}
+
+// WriteJsonFile replaces filename atomically, keeping its permissions.
+func WriteJsonFile(filename string, v interface{}) (err error) {
+	var perm os.FileMode
+	if perm, err = filePerm(filename); err != nil {
+		return
+	}
+	var buffer []byte
+	if buffer, err = json.Marshal(v); err == nil {
+		err = WriteFileAtomic(filename, buffer, perm)
 	}
 	return
 }
@@ -187,17 +215,259 @@ func ReadTextFile(filename string) (content string, ok bool) {
 	return
 }
 
+// WriteTextFile replaces filename atomically, keeping its permissions.
 func WriteTextFile(filename string, content string) (err error) {
+	var perm os.FileMode
+	if perm, err = filePerm(filename); err == nil {
+		err = WriteFileAtomic(filename, []byte(content), perm)
+	}
+	return
+}
+
+// WriteFileAtomic writes content to a temporary file next to filename, syncs
+// it and renames it over filename, so that readers see either the old or the
+// new content even if the process crashes halfway.
+func WriteFileAtomic(filename string, content []byte, perm os.FileMode) (err error) {
+	var file *os.File
+	if file, err = ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+`.*.tmp`); err != nil {
+		return
+	}
+	var tempFile = file.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tempFile)
+		}
+	}()
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(tempFile, perm); err != nil {
+		return
+	}
+	if err = os.Rename(tempFile, filename); err != nil {
+		return
+	}
+	// Persist the rename itself; directories cannot be synced on Windows.
+	if dir, e := os.Open(filepath.Dir(filename)); e == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return
+}
+
+// TempDirBeside creates a temporary directory next to path, so that files
+// can be renamed between the two, or in the system temporary directory when
+// that is not possible.
+func TempDirBeside(path, pattern string) (dir string, err error) {
+	if dir, err = ioutil.TempDir(filepath.Dir(path), `.`+filepath.Base(path)+`-`+pattern); err == nil {
+		return
+	}
+	return ioutil.TempDir(os.TempDir(), pattern)
+}
+
+// mkdirAll creates dir like os.MkdirAll and returns the directories it
+// created, parents first.
+func mkdirAll(dir string) (created []string, err error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, e := os.Lstat(d); e == nil || filepath.Dir(d) == d {
+			break
+		}
+		created = append([]string{d}, created...)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		created = nil
+	}
+	return
+}
+
+// removeDirs removes directories recorded by mkdirAll, deepest first,
+// leaving those that are not empty.
+func removeDirs(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		_ = os.Remove(created[i])
+	}
+}
+
+// moveFile renames src to dest, copying it across file systems.
+func moveFile(src, dest string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return
+	}
+	if os.Rename(src, dest) == nil {
+		return
+	}
 	var info os.FileInfo
-	if info, err = os.Stat(filename); err == nil || os.IsNotExist(err) || !info.IsDir() {
-		var perm os.FileMode
-		if info != nil {
-			perm = info.Mode()
+	if info, err = os.Stat(src); err != nil {
+		return
+	}
+	if err = copyFile(src, dest, info.Mode()); err == nil {
+		err = os.Remove(src)
+	}
+	return
+}
+
+// localPath converts a slash separated path relative to a directory to the
+// local form, refusing one that leaves the directory.
+func localPath(rel string) (string, error) {
+	var local = filepath.Clean(filepath.FromSlash(rel))
+	if rel == `` || filepath.IsAbs(local) || local == `.` || local == `..` || strings.HasPrefix(local, `..`+string(filepath.Separator)) {
+		return ``, fmt.Errorf(`invalid relative path: %s`, rel)
+	}
+	return local, nil
+}
+
+// SwapFiles moves the files of src into dest and removes the files of dest
+// named by remove, slash separated paths relative to dest. Every file it
+// replaces or removes is moved aside first, and when ctx is cancelled or a
+// move fails, dest is rolled back to its previous content. Within one file
+// system the moves are renames, so each file of dest is always either the
+// old or the new one.
+func SwapFiles(ctx context.Context, src, dest string, remove []string) (err error) {
+	var backupDir string
+	if backupDir, err = TempDirBeside(dest, `rollback`); err != nil {
+		return
+	}
+	defer os.RemoveAll(backupDir)
+	var saved, created, dirs []string
+	var save = func(rel string) (err error) {
+		if info, e := os.Lstat(filepath.Join(dest, rel)); e != nil || info.IsDir() {
+			return nil
+		}
+		if err = moveFile(filepath.Join(dest, rel), filepath.Join(backupDir, rel)); err == nil {
+			saved = append(saved, rel)
+		}
+		return
+	}
+	err = filepath.Walk(src, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		var rel string
+		if rel, err = filepath.Rel(src, name); err != nil {
+			return err
+		}
+		var made []string
+		if made, err = mkdirAll(filepath.Dir(filepath.Join(dest, rel))); err != nil {
+			return err
+		}
+		dirs = append(dirs, made...)
+		var count = len(saved)
+		if err = save(rel); err != nil {
+			return err
+		}
+		if len(saved) == count {
+			created = append(created, rel)
+		}
+		return moveFile(name, filepath.Join(dest, rel))
+	})
+	for _, name := range remove {
+		if err != nil {
+			break
+		}
+		var rel string
+		if rel, err = localPath(name); err == nil {
+			if err = ctx.Err(); err == nil {
+				err = save(rel)
+			}
+		}
+	}
+	if err != nil {
+		for _, rel := range created {
+			_ = os.Remove(filepath.Join(dest, rel))
+		}
+		for _, rel := range saved {
+			_ = moveFile(filepath.Join(backupDir, rel), filepath.Join(dest, rel))
 		}
-		if perm < 1 {
-			perm = 0644
+		removeDirs(dirs)
+	}
+	return
+}
+
+func copyFile(src, dest string, perm os.FileMode) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return
+	}
+	var srcFile *os.File
+	if srcFile, err = os.Open(src); err != nil {
+		return
+	}
+	defer srcFile.Close()
+	var destFile *os.File
+	if destFile, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm); err != nil {
+		return
+	}
+	if _, err = io.Copy(destFile, bufio.NewReader(srcFile)); err != nil {
+		_ = destFile.Close()
+		return
+	}
+	err = destFile.Close()
+	return
+}
+
+// InstallFiles copies src over dest like CopyFiles, but saves every file it
+// overwrites first. When ctx is cancelled or a copy fails, dest is rolled back
+// to its previous content and the directories it created are removed.
+func InstallFiles(ctx context.Context, src, dest string) (err error) {
+	var backupDir string
+	if backupDir, err = ioutil.TempDir(os.TempDir(), `rollback`); err != nil {
+		return
+	}
+	defer os.RemoveAll(backupDir)
+	var replaced, created, dirs []string
+	err = filepath.Walk(src, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		var rel string
+		if rel, err = filepath.Rel(src, name); err != nil {
+			return err
+		}
+		var target = filepath.Join(dest, rel)
+		if targetInfo, err := os.Stat(target); err == nil && !targetInfo.IsDir() {
+			if err = copyFile(target, filepath.Join(backupDir, rel), targetInfo.Mode()); err != nil {
+				return err
+			}
+			replaced = append(replaced, rel)
+		} else {
+			created = append(created, rel)
+		}
+		var made []string
+		made, err = mkdirAll(filepath.Dir(target))
+		dirs = append(dirs, made...)
+		if err != nil {
+			return err
+		}
+		return copyFile(name, target, info.Mode())
+	})
+	if err != nil {
+		for _, rel := range created {
+			_ = os.Remove(filepath.Join(dest, rel))
+		}
+		for _, rel := range replaced {
+			var backup = filepath.Join(backupDir, rel)
+			if info, e := os.Stat(backup); e == nil {
+				_ = copyFile(backup, filepath.Join(dest, rel), info.Mode())
+			}
 		}
-		err = ioutil.WriteFile(filename, []byte(content), info.Mode())
+		removeDirs(dirs)
 	}
 	return
 }
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files, slash separated paths mapped to their content,
+// under dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		var filename = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns every file and directory under dir; directories map to a
+// trailing slash.
+func readTree(t *testing.T, dir string) map[string]string {
+	var files = make(map[string]string)
+	var err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		var rel, _ = filepath.Rel(dir, name)
+		if info.IsDir() {
+			files[filepath.ToSlash(rel)+`/`] = ``
+			return nil
+		}
+		var content, e = ioutil.ReadFile(name)
+		files[filepath.ToSlash(rel)] = string(content)
+		return e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func treeString(files map[string]string) string {
+	var lines []string
+	for name, content := range files {
+		lines = append(lines, name+`=`+content)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ` `)
+}
+
+func TestSwapFiles(t *testing.T) {
+	var original = map[string]string{`bin/app`: `1`, `lib/old.so`: `1`, `data/app.db`: `keep`}
+	var tests = []struct {
+		name   string
+		src    map[string]string
+		remove []string
+		want   map[string]string
+		err    bool
+	}{
+		{`swap and remove`, map[string]string{`bin/app`: `2`, `lib/new/plugin.so`: `2`}, []string{`lib/old.so`, `lib/gone.so`},
+			map[string]string{`bin/`: ``, `bin/app`: `2`, `lib/`: ``, `lib/new/`: ``, `lib/new/plugin.so`: `2`, `data/`: ``, `data/app.db`: `keep`}, false},
+		{`rolled back`, map[string]string{`bin/app`: `2`, `lib/new/plugin.so`: `2`}, []string{`lib/old.so`, `../outside`},
+			map[string]string{`bin/`: ``, `bin/app`: `1`, `lib/`: ``, `lib/old.so`: `1`, `data/`: ``, `data/app.db`: `keep`}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var src, dest = filepath.Join(t.TempDir(), `src`), filepath.Join(t.TempDir(), `dest`)
+			writeTree(t, src, test.src)
+			writeTree(t, dest, original)
+			var err = SwapFiles(context.Background(), src, dest, test.remove)
+			if (err != nil) != test.err {
+				t.Fatalf(`got error %v, want one: %t`, err, test.err)
+			}
+			if got := treeString(readTree(t, dest)); got != treeString(test.want) {
+				t.Errorf("dest holds\n%s\nwant\n%s", got, treeString(test.want))
+			}
+			if backups, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), `.dest-rollback*`)); len(backups) > 0 {
+				t.Errorf(`backup directories left behind: %v`, backups)
+			}
+		})
+	}
+}
+
+func TestSwapFilesCancelled(t *testing.T) {
+	var src, dest = filepath.Join(t.TempDir(), `src`), filepath.Join(t.TempDir(), `dest`)
+	writeTree(t, src, map[string]string{`bin/app`: `2`})
+	writeTree(t, dest, map[string]string{`bin/app`: `1`})
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := SwapFiles(ctx, src, dest, nil); err != context.Canceled {
+		t.Fatalf(`got error %v, want context.Canceled`, err)
+	}
+	if got := treeString(readTree(t, dest)); got != `bin/= bin/app=1` {
+		t.Errorf(`dest holds %s after a cancelled swap`, got)
+	}
+}
+
+func TestInstallFilesRollback(t *testing.T) {
+	var src, dest = filepath.Join(t.TempDir(), `src`), filepath.Join(t.TempDir(), `dest`)
+	// data is a directory in dest, so copying the file data over it fails
+	// after the other files are in place.
+	writeTree(t, src, map[string]string{`a/new/deep/x`: `2`, `bin/app`: `2`, `data`: `2`})
+	writeTree(t, dest, map[string]string{`bin/app`: `1`, `data/app.db`: `keep`})
+	if err := InstallFiles(context.Background(), src, dest); err == nil {
+		t.Fatal(`copying a file over a directory succeeded`)
+	}
+	if got := treeString(readTree(t, dest)); got != `bin/= bin/app=1 data/= data/app.db=keep` {
+		t.Errorf(`dest holds %s after a failed install`, got)
+	}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LocalPath reports whether uri points to the local file system, either as a
+// file:// URL or as a plain path, and returns that path.
+func LocalPath(uri string) (filename string, ok bool) {
+	var u, err = url.Parse(uri)
+	if err != nil || u.Scheme == `` || len(u.Scheme) == 1 {
+		return uri, true
+	}
+	if u.Scheme != `file` {
+		return
+	}
+	filename = u.Path
+	if u.Host != `` && u.Host != `localhost` {
+		filename = `//` + u.Host + u.Path
+	}
+	if runtime.GOOS == `windows` && len(filename) > 2 && filename[0] == '/' && filename[2] == ':' {
+		filename = filename[1:]
+	}
+	return filepath.FromSlash(filename), true
+}
+
+func readLocalText(filename string, validators Validators) (result string, modified bool, latest Validators, err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(filename); err != nil {
+		return
+	}
+	latest = Validators{LastModified: info.ModTime().UTC().Format(http.TimeFormat)}
+	if validators.LastModified == latest.LastModified && validators.ETag == `` {
+		return
+	}
+	var buffer []byte
+	if buffer, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	result = strings.TrimSpace(string(buffer))
+	modified = true
+	return
+}
+
+func copyLocalFile(ctx context.Context, filename, src string, limiters ...*RateLimiter) (err error) {
+	var srcFile *os.File
+	if srcFile, err = os.Open(src); err != nil {
+		return
+	}
+	defer srcFile.Close()
+	var partFile = filename + `.part`
+	var destFile *os.File
+	if destFile, err = os.Create(partFile); err != nil {
+		return
+	}
+	_, err = io.Copy(destFile, NewRateLimitedReader(ctx, srcFile, limiters...))
+	if e := destFile.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(partFile, filename)
+	}
+	return
+}
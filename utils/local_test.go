@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		filename string
+		ok       bool
+	}{
+		{`/srv/releases/app.zip`, `/srv/releases/app.zip`, true},
+		{`releases/app.zip`, `releases/app.zip`, true},
+		{`file:///srv/releases/app.zip`, `/srv/releases/app.zip`, true},
+		{`file://localhost/srv/releases/app.zip`, `/srv/releases/app.zip`, true},
+		{`file://server/share/app.zip`, `//server/share/app.zip`, true},
+		{`file:///srv/releases/app%201.zip`, `/srv/releases/app 1.zip`, true},
+		{`https://example.com/app.zip`, ``, false},
+		{`s3://bucket/app.zip`, ``, false},
+	}
+	if runtime.GOOS == `windows` {
+		tests = append(tests, []struct {
+			uri      string
+			filename string
+			ok       bool
+		}{
+			{`C:\releases\app.zip`, `C:\releases\app.zip`, true},
+			{`file:///C:/releases/app.zip`, `C:\releases\app.zip`, true},
+		}...)
+	}
+	for _, test := range tests {
+		var filename, ok = LocalPath(test.uri)
+		if ok != test.ok || ok && filename != filepath.FromSlash(test.filename) {
+			t.Errorf(`LocalPath(%q) = %q, %t, want %q, %t`, test.uri, filename, ok, test.filename, test.ok)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"os"
+)
+
+// LockFile takes an exclusive lock shared with other processes, such as the
+// applications reading upgrade.ready, before filename is read or replaced.
+// The lock is held on filename.lock rather than filename itself, because
+// WriteFileAtomic replaces filename with a new file. It blocks until the lock
+// is free; the returned function releases it. A process that may not write
+// the lock file, such as an application reading upgrade.ready, locks it
+// through a read-only handle.
+func LockFile(filename string) (unlock func(), err error) {
+	var file *os.File
+	if file, err = os.OpenFile(filename+`.lock`, os.O_CREATE|os.O_RDWR, 0644); os.IsPermission(err) {
+		file, err = os.Open(filename + `.lock`)
+	}
+	if err != nil {
+		return
+	}
+	if err = lockFile(file); err != nil {
+		_ = file.Close()
+		return
+	}
+	unlock = func() {
+		_ = unlockFile(file)
+		_ = file.Close()
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockfileExclusiveLock = 0x2
+
+var (
+	kernel32         = syscall.NewLazyDLL(`kernel32.dll`)
+	procLockFileEx   = kernel32.NewProc(`LockFileEx`)
+	procUnlockFileEx = kernel32.NewProc(`UnlockFileEx`)
+)
+
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	var r, _, err = procLockFileEx.Call(file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	var r, _, err = procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -2,98 +2,450 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 )
 
-func RequestText(url, method, body string) (result string, statusCode uint16, err error) {
-	var client = &http.Client{}
-	var req *http.Request
-	if body != `` {
-		if req, err = http.NewRequest(method, url, bytes.NewBuffer([]byte(body))); err != nil {
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultReadTimeout    = 60 * time.Second
+)
+
+var reLinkNext = regexp.MustCompile(`<([^>]*)>[^,]*;\s*rel="?next"?`)
+
+type HttpOptions struct {
+	ConnectTimeout time.Duration `yaml:"connectTimeout,omitempty"`
+	ReadTimeout    time.Duration `yaml:"readTimeout,omitempty"`
+	Timeout        time.Duration `yaml:"timeout,omitempty"`
+	Proxy          string        `yaml:"proxy,omitempty"`
+	NoProxy        string        `yaml:"noProxy,omitempty"`
+	CaFile         string        `yaml:"caFile,omitempty"`
+	CertFile       string        `yaml:"certFile,omitempty"`
+	KeyFile        string        `yaml:"keyFile,omitempty"`
+	Pins           []string      `yaml:"pins,omitempty"`
+}
+
+func (o HttpOptions) Merge(override HttpOptions) HttpOptions {
+	if override.ConnectTimeout != 0 {
+		o.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.ReadTimeout != 0 {
+		o.ReadTimeout = override.ReadTimeout
+	}
+	if override.Timeout != 0 {
+		o.Timeout = override.Timeout
+	}
+	if override.Proxy != `` {
+		o.Proxy = override.Proxy
+	}
+	if override.NoProxy != `` {
+		o.NoProxy = override.NoProxy
+	}
+	if override.CaFile != `` {
+		o.CaFile = override.CaFile
+	}
+	if override.CertFile != `` {
+		o.CertFile = override.CertFile
+		o.KeyFile = override.KeyFile
+	}
+	if len(override.Pins) > 0 {
+		o.Pins = override.Pins
+	}
+	return o
+}
+
+type HttpClient struct {
+	client      *http.Client
+	auth        *HttpAuth
+	sign        func(req *http.Request) error
+	reauthorize func(ctx context.Context, challenge string) error
+}
+
+var DefaultHttpClient, _ = NewHttpClient(HttpOptions{})
+
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func NewHttpClient(options HttpOptions) (client *HttpClient, err error) {
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaultConnectTimeout
+	}
+	if options.ReadTimeout <= 0 {
+		options.ReadTimeout = defaultReadTimeout
+	}
+	var tlsConfig = &tls.Config{}
+	if options.CaFile != `` {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(options.CaFile); err != nil {
 			return
 		}
-	} else {
-		if req, err = http.NewRequest(method, url, nil); err != nil {
+		var pool *x509.CertPool
+		if pool, err = x509.SystemCertPool(); err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf(`no certificate found in %s`, options.CaFile)
+			return
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if options.CertFile != `` {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(options.CertFile, options.KeyFile); err != nil {
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(options.Pins) > 0 {
+		var pins = make(map[string]bool)
+		for _, pin := range options.Pins {
+			pins[strings.TrimPrefix(pin, `sha256/`)] = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				var sum = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New(`no pinned public key found in certificate chain`)
+		}
+	}
+	var proxy = http.ProxyFromEnvironment
+	if options.Proxy != `` {
+		var proxyUrl *url.URL
+		if proxyUrl, err = url.Parse(options.Proxy); err != nil {
 			return
 		}
+		var noProxy = strings.Split(options.NoProxy, `,`)
+		proxy = func(req *http.Request) (*url.URL, error) {
+			if matchNoProxy(req.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxyUrl, nil
+		}
+	}
+	var dialer = &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+	var readTimeout = options.ReadTimeout
+	client = &HttpClient{
+		client: &http.Client{
+			Timeout: options.Timeout,
+			Transport: &http.Transport{
+				Proxy: proxy,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var conn, err = dialer.DialContext(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return &idleTimeoutConn{Conn: conn, timeout: readTimeout}, nil
+				},
+				TLSClientConfig:       tlsConfig,
+				TLSHandshakeTimeout:   options.ConnectTimeout,
+				ResponseHeaderTimeout: readTimeout,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConns:          16,
+				ForceAttemptHTTP2:     true,
+			},
+			CheckRedirect: stripAuthOnRedirect,
+		},
+	}
+	return
+}
+
+// stripAuthOnRedirect drops the headers HttpAuth set once a redirect leaves
+// the host of the original request; net/http itself only drops
+// Authorization, WWW-Authenticate and Cookie, and only for other domains.
+func stripAuthOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New(`stopped after 10 redirects`)
+	}
+	if names, ok := req.Context().Value(authHeadersKey{}).([]string); ok && !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		for _, name := range names {
+			req.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+func matchNoProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	for _, item := range noProxy {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == `` {
+			continue
+		}
+		if item == `*` || host == strings.TrimPrefix(item, `.`) || strings.HasSuffix(host, `.`+strings.TrimPrefix(item, `.`)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *HttpClient) WithAuth(auth HttpAuth) *HttpClient {
+	if auth.IsEmpty() {
+		return c
+	}
+	return &HttpClient{client: c.client, auth: &auth, sign: c.sign, reauthorize: c.reauthorize}
+}
+
+func (c *HttpClient) WithSigner(sign func(req *http.Request) error) *HttpClient {
+	return &HttpClient{client: c.client, auth: c.auth, sign: sign, reauthorize: c.reauthorize}
+}
+
+// WithReauthorizer returns a client that answers a 401 response carrying a
+// WWW-Authenticate challenge by calling reauthorize and sending the request
+// once more, such as when a registry token has expired.
+func (c *HttpClient) WithReauthorizer(reauthorize func(ctx context.Context, challenge string) error) *HttpClient {
+	return &HttpClient{client: c.client, auth: c.auth, sign: c.sign, reauthorize: reauthorize}
+}
+
+// do sends the request made by build, and builds and sends it again after a
+// 401 challenge the reauthorizer accepted.
+func (c *HttpClient) do(ctx context.Context, build func() (*http.Request, error)) (resp *http.Response, err error) {
+	var req *http.Request
+	if req, err = build(); err != nil {
+		return
+	}
+	if resp, err = c.client.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized || c.reauthorize == nil {
+		return
+	}
+	var challenge = resp.Header.Get(`WWW-Authenticate`)
+	if challenge == `` || c.reauthorize(ctx, challenge) != nil {
+		return
+	}
+	_ = resp.Body.Close()
+	if req, err = build(); err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
+func (c *HttpClient) newRequest(ctx context.Context, url, method, body string) (req *http.Request, err error) {
+	if body != `` {
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer([]byte(body)))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
+	}
+	if err == nil && c.auth != nil && c.auth.Allows(req.URL) {
+		req = req.WithContext(context.WithValue(req.Context(), authHeadersKey{}, c.auth.headerNames()))
+		err = c.auth.Apply(req)
+	}
+	if err == nil && c.sign != nil {
+		err = c.sign(req)
+	}
+	return
+}
+
+func (c *HttpClient) RequestText(ctx context.Context, url, method, body string) (result string, statusCode uint16, err error) {
+	if filename, ok := LocalPath(url); ok {
+		result, _, _, err = readLocalText(filename, Validators{})
+		return
+	}
+	var req *http.Request
+	if req, err = c.newRequest(ctx, url, method, body); err != nil {
+		return
 	}
 	var resp *http.Response
-	if resp, err = client.Do(req); err != nil {
+	if resp, err = c.client.Do(req); err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	statusCode = uint16(resp.StatusCode)
+	if err = checkStatus(resp); err != nil {
+		return
+	}
 	var buffer []byte
 	if buffer, err = ioutil.ReadAll(resp.Body); err != nil {
 		return
 	}
-	defer resp.Body.Close()
 	result = strings.TrimSpace(string(buffer))
 	return
 }
 
-func RequestJson(url, method string, params []interface{}, reply interface{}) (statusCode uint16, err error) {
-	var client = &http.Client{}
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// RequestTextIfModified is a conditional GET. When the server answers
+// 304 Not Modified, modified is false and result is empty. Local files are
+// compared by modification time.
+func (c *HttpClient) RequestTextIfModified(ctx context.Context, url string, validators Validators) (result string, modified bool, latest Validators, err error) {
+	if filename, ok := LocalPath(url); ok {
+		return readLocalText(filename, validators)
+	}
 	var req *http.Request
-	if params != nil && len(params) > 0 {
-		var body []byte
-		if body, err = json.Marshal(params); err != nil {
-			return
-		}
-		if req, err = http.NewRequest(method, url, bytes.NewBuffer(body)); err != nil {
-			return
-		}
-	} else {
-		if req, err = http.NewRequest(method, url, nil); err != nil {
+	if req, err = c.newRequest(ctx, url, `GET`, ``); err != nil {
+		return
+	}
+	if validators.ETag != `` {
+		req.Header.Set(`If-None-Match`, validators.ETag)
+	}
+	if validators.LastModified != `` {
+		req.Header.Set(`If-Modified-Since`, validators.LastModified)
+	}
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		latest = validators
+		return
+	}
+	if err = checkStatus(resp); err != nil {
+		return
+	}
+	var buffer []byte
+	if buffer, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	result = strings.TrimSpace(string(buffer))
+	modified = true
+	latest = Validators{ETag: resp.Header.Get(`ETag`), LastModified: resp.Header.Get(`Last-Modified`)}
+	return
+}
+
+func (c *HttpClient) RequestJson(ctx context.Context, url, method string, params []interface{}, reply interface{}) (statusCode uint16, err error) {
+	var body string
+	if len(params) > 0 {
+		var buffer []byte
+		if buffer, err = json.Marshal(params); err != nil {
 			return
 		}
+		body = string(buffer)
 	}
-	req.Header.Set(`Content-Type`, `application/json`)
 	var resp *http.Response
-	if resp, err = client.Do(req); err != nil {
+	if resp, err = c.do(ctx, func() (req *http.Request, err error) {
+		if req, err = c.newRequest(ctx, url, method, body); err == nil {
+			req.Header.Set(`Content-Type`, `application/json`)
+		}
+		return
+	}); err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	statusCode = uint16(resp.StatusCode)
+	if err = checkStatus(resp); err != nil {
+		return
+	}
 	var buffer []byte
 	if buffer, err = ioutil.ReadAll(resp.Body); err != nil {
 		return
 	}
+	err = json.Unmarshal(buffer, &reply)
+	return
+}
+
+// RequestJsonPage GETs one page of a paginated JSON list into reply and
+// returns the URL of the next page, named by a Link header with rel="next"
+// and resolved against the page URL, or an empty string on the last page.
+func (c *HttpClient) RequestJsonPage(ctx context.Context, uri string, reply interface{}) (next string, err error) {
+	var resp *http.Response
+	if resp, err = c.do(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, uri, `GET`, ``)
+	}); err != nil {
+		return
+	}
 	defer resp.Body.Close()
-	if err = json.Unmarshal(buffer, &reply); err != nil {
+	if err = checkStatus(resp); err != nil {
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
 		return
 	}
+	for _, link := range resp.Header.Values(`Link`) {
+		if match := reLinkNext.FindStringSubmatch(link); match != nil {
+			var ref *url.URL
+			if ref, err = resp.Request.URL.Parse(match[1]); err == nil {
+				next = ref.String()
+			}
+			break
+		}
+	}
 	return
 }
 
-func DownloadFile(filename, url, method, body string) (statusCode uint16, err error) {
-	var fp *os.File
-	fp, err = os.Create(filename)
-	if err != nil {
+// Send issues a request with the given headers and discards the response
+// body. Any status other than 2xx is returned as a *StatusError.
+func (c *HttpClient) Send(ctx context.Context, url, method string, header http.Header, body string) (statusCode uint16, err error) {
+	var req *http.Request
+	if req, err = c.newRequest(ctx, url, method, body); err != nil {
+		return
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
 		return
 	}
-	defer fp.Close()
-	var client = &http.Client{}
+	defer resp.Body.Close()
+	statusCode = uint16(resp.StatusCode)
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	err = checkStatus(resp)
+	return
+}
+
+// DownloadFile writes the response body to filename. A non-2xx response is
+// an error and leaves filename untouched.
+func (c *HttpClient) DownloadFile(ctx context.Context, filename, url, method, body string) (statusCode uint16, err error) {
 	var req *http.Request
-	if body != `` {
-		if req, err = http.NewRequest(method, url, bytes.NewBuffer([]byte(body))); err != nil {
-			return
-		}
-	} else {
-		if req, err = http.NewRequest(method, url, nil); err != nil {
-			return
-		}
+	if req, err = c.newRequest(ctx, url, method, body); err != nil {
+		return
 	}
 	var resp *http.Response
-	if resp, err = client.Do(req); err != nil {
+	if resp, err = c.client.Do(req); err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	statusCode = uint16(resp.StatusCode)
-	if _, err = io.Copy(fp, resp.Body); err != nil {
+	if err = checkStatus(resp); err != nil {
 		return
 	}
+	var fp *os.File
+	if fp, err = os.Create(filename); err != nil {
+		return
+	}
+	_, err = io.Copy(fp, resp.Body)
+	if e := fp.Close(); err == nil {
+		err = e
+	}
 	return
 }
+
+func RequestText(ctx context.Context, url, method, body string) (string, uint16, error) {
+	return DefaultHttpClient.RequestText(ctx, url, method, body)
+}
+
+func RequestJson(ctx context.Context, url, method string, params []interface{}, reply interface{}) (uint16, error) {
+	return DefaultHttpClient.RequestJson(ctx, url, method, params, reply)
+}
+
+func DownloadFile(ctx context.Context, filename, url, method, body string) (uint16, error) {
+	return DefaultHttpClient.DownloadFile(ctx, filename, url, method, body)
+}
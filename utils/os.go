@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,17 +9,18 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strings"
 )
 
-func ExecCommand(command string, arg ...string) (result []byte, err error) {
+func ExecCommand(ctx context.Context, command string, arg ...string) (result []byte, err error) {
 	if !strings.Contains(command, string(os.PathSeparator)) {
 		command, err = exec.LookPath(command)
 		if err != nil {
 			return
 		}
 	}
-	var cmd = exec.Command(command, arg...)
+	var cmd = exec.CommandContext(ctx, command, arg...)
 	var stdout, stderr io.ReadCloser
 	stdout, err = cmd.StdoutPipe()
 	if err != nil {
@@ -45,7 +47,7 @@ func ExecCommand(command string, arg ...string) (result []byte, err error) {
 
 var reCommandline = regexp.MustCompile(`"(.+)"\s*(.+)?`)
 
-func ExecCommandString(command string) (result string, err error) {
+func ExecCommandString(ctx context.Context, command string) (result string, err error) {
 	var parts = reCommandline.FindStringSubmatch(command)
 	var args []string
 	if len(parts) == 0 {
@@ -57,8 +59,42 @@ func ExecCommandString(command string) (result string, err error) {
 		args = parts[2:]
 	}
 	var buffer []byte
-	if buffer, err = ExecCommand(command, args...); err == nil {
+	if buffer, err = ExecCommand(ctx, command, args...); err == nil {
 		result = string(buffer)
 	}
 	return
 }
+
+var reMachineGuid = regexp.MustCompile(`MachineGuid\s+REG_SZ\s+(\S+)`)
+var rePlatformUuid = regexp.MustCompile(`"IOPlatformUUID"\s*=\s*"([^"]+)"`)
+
+func MachineID(ctx context.Context) (id string, err error) {
+	switch runtime.GOOS {
+	case `windows`:
+		var buffer []byte
+		if buffer, err = ExecCommand(ctx, `reg`, `query`, `HKLM\SOFTWARE\Microsoft\Cryptography`, `/v`, `MachineGuid`); err == nil {
+			if parts := reMachineGuid.FindStringSubmatch(string(buffer)); len(parts) > 1 {
+				id = parts[1]
+			}
+		}
+	case `darwin`:
+		var buffer []byte
+		if buffer, err = ExecCommand(ctx, `ioreg`, `-rd1`, `-c`, `IOPlatformExpertDevice`); err == nil {
+			if parts := rePlatformUuid.FindStringSubmatch(string(buffer)); len(parts) > 1 {
+				id = parts[1]
+			}
+		}
+	default:
+		for _, filename := range []string{`/etc/machine-id`, `/var/lib/dbus/machine-id`} {
+			if content, ok := ReadTextFile(filename); ok {
+				if id = strings.TrimSpace(content); id != `` {
+					break
+				}
+			}
+		}
+	}
+	if id == `` {
+		id, err = os.Hostname()
+	}
+	return
+}
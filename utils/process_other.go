@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ProcessRunning reports whether a process with the given id exists.
+func ProcessRunning(pid int) bool {
+	var err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Detach has cmd start in a session of its own, so that it outlives the
+// process group of the caller.
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+	detachedProcess                = 0x8
+)
+
+// ProcessRunning reports whether a process with the given id exists.
+func ProcessRunning(pid int) bool {
+	var handle, err = syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(handle)
+	var code uint32
+	if err = syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// Detach has cmd start without a console in a process group of its own, so
+// that it outlives the caller.
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ByteSize int64
+
+func ParseByteSize(value string) (size ByteSize, err error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	var multiplier int64 = 1
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{`GB`, 1 << 30}, {`MB`, 1 << 20}, {`KB`, 1 << 10},
+		{`G`, 1 << 30}, {`M`, 1 << 20}, {`K`, 1 << 10}, {`B`, 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	var number float64
+	if number, err = strconv.ParseFloat(value, 64); err != nil {
+		err = fmt.Errorf(`invalid byte size: %s`, value)
+		return
+	}
+	size = ByteSize(number * float64(multiplier))
+	return
+}
+
+func (s *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var value string
+	if err = unmarshal(&value); err == nil {
+		*s, err = ParseByteSize(value)
+	}
+	return
+}
+
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond ByteSize) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	var now = time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	var timer = time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rateLimitedReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*RateLimiter
+}
+
+func NewRateLimitedReader(ctx context.Context, reader io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, reader: reader, limiters: limiters}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	if n, err = r.reader.Read(p); n > 0 {
+		for _, limiter := range r.limiters {
+			if e := limiter.WaitN(r.ctx, n); e != nil {
+				return n, e
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  ByteSize
+		err   bool
+	}{
+		{`0`, 0, false},
+		{`512`, 512, false},
+		{`512B`, 512, false},
+		{`1K`, 1 << 10, false},
+		{`1kb`, 1 << 10, false},
+		{`1.5M`, 3 << 19, false},
+		{` 2 MB `, 2 << 20, false},
+		{`1G`, 1 << 30, false},
+		{`1GB`, 1 << 30, false},
+		{``, 0, true},
+		{`MB`, 0, true},
+		{`fast`, 0, true},
+		{`10 KiB`, 0, true},
+	}
+	for _, test := range tests {
+		var got, err = ParseByteSize(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf(`ParseByteSize(%q) = %d, want an error`, test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf(`ParseByteSize(%q) = %d, %v, want %d`, test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestByteSizeYaml(t *testing.T) {
+	var config struct {
+		RateLimit ByteSize `yaml:"rateLimit"`
+	}
+	if err := yaml.Unmarshal([]byte(`rateLimit: 2M`), &config); err != nil || config.RateLimit != 2<<20 {
+		t.Errorf(`rateLimit: 2M decoded as %d, %v`, config.RateLimit, err)
+	}
+	if err := yaml.Unmarshal([]byte(`rateLimit: fast`), &config); err == nil {
+		t.Error(`rateLimit: fast was accepted`)
+	}
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const unsignedPayload = `UNSIGNED-PAYLOAD`
+
+type SigV4Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	var mac = hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// AwsEscape encodes s the way AWS Signature Version 4 expects: everything but
+// unreserved characters is percent-encoded, and '/' only when escapeSlash.
+func AwsEscape(s string, escapeSlash bool) string {
+	var buffer strings.Builder
+	for i := 0; i < len(s); i++ {
+		var c = s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !escapeSlash {
+			buffer.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buffer, `%%%02X`, c)
+		}
+	}
+	return buffer.String()
+}
+
+func canonicalQuery(values url.Values) string {
+	var keys = make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		var items = append([]string(nil), values[key]...)
+		sort.Strings(items)
+		for _, value := range items {
+			parts = append(parts, AwsEscape(key, true)+`=`+AwsEscape(value, true))
+		}
+	}
+	return strings.Join(parts, `&`)
+}
+
+// SignV4 signs req for service in region with AWS Signature Version 4. The
+// payload is not signed, which S3 and compatible stores accept, unless the
+// caller has set its hash in X-Amz-Content-Sha256.
+func SignV4(req *http.Request, credentials SigV4Credentials, region, service string, now time.Time) {
+	var amzDate = now.UTC().Format(`20060102T150405Z`)
+	var date = amzDate[:8]
+	req.Header.Set(`X-Amz-Date`, amzDate)
+	var payloadHash = req.Header.Get(`X-Amz-Content-Sha256`)
+	if payloadHash == `` {
+		payloadHash = unsignedPayload
+		req.Header.Set(`X-Amz-Content-Sha256`, payloadHash)
+	}
+	if credentials.SessionToken != `` {
+		req.Header.Set(`X-Amz-Security-Token`, credentials.SessionToken)
+	}
+	var host = req.Host
+	if host == `` {
+		host = req.URL.Host
+	}
+	var headers = map[string]string{`host`: host}
+	for name, values := range req.Header {
+		var lower = strings.ToLower(name)
+		if strings.HasPrefix(lower, `x-amz-`) {
+			headers[lower] = strings.TrimSpace(strings.Join(values, `,`))
+		}
+	}
+	var names = make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + `:` + headers[name] + "\n")
+	}
+	var signedHeaders = strings.Join(names, `;`)
+	var path = req.URL.EscapedPath()
+	if path == `` {
+		path = `/`
+	}
+	var canonicalRequest = strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	var scope = fmt.Sprintf(`%s/%s/%s/aws4_request`, date, region, service)
+	var requestHash = sha256.Sum256([]byte(canonicalRequest))
+	var stringToSign = strings.Join([]string{`AWS4-HMAC-SHA256`, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	var key = hmacSha256([]byte(`AWS4`+credentials.SecretAccessKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, `aws4_request`)
+	req.Header.Set(`Authorization`, fmt.Sprintf(`AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s`,
+		credentials.AccessKeyId, scope, signedHeaders, hex.EncodeToString(hmacSha256(key, stringToSign))))
+}
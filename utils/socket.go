@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenSocket listens on the Unix socket at path, readable and writable only
+// as mode allows from the moment it appears. A socket left behind by an
+// earlier run is replaced; any other file at path is an error.
+func ListenSocket(path string, mode os.FileMode) (listener net.Listener, err error) {
+	if info, e := os.Lstat(path); e == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf(`%s exists and is not a socket`, path)
+		}
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+	return listenSocket(path, mode)
+}
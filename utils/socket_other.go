@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenSocket creates the socket in a private directory next to path, sets
+// its mode there and then moves it into place, so that it is never reachable
+// with the permissions of the umask.
+func listenSocket(path string, mode os.FileMode) (listener net.Listener, err error) {
+	var dir string
+	if dir, err = ioutil.TempDir(filepath.Dir(path), `.`+filepath.Base(path)+`-`); err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	var temp = filepath.Join(dir, `socket`)
+	var unixListener *net.UnixListener
+	if unixListener, err = net.ListenUnix(`unix`, &net.UnixAddr{Name: temp, Net: `unix`}); err != nil {
+		return
+	}
+	unixListener.SetUnlinkOnClose(false)
+	if err = os.Chmod(temp, mode); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		_ = unixListener.Close()
+		return nil, err
+	}
+	return unixListener, nil
+}
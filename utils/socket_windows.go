@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"net"
+	"os"
+)
+
+func listenSocket(path string, mode os.FileMode) (listener net.Listener, err error) {
+	if listener, err = net.Listen(`unix`, path); err != nil {
+		return
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return
+}